@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	// logFormats write the access log, one line per request, at debug level.
+	logFormats = map[string]func(entry accessLogEntry){
+		"text": func(entry accessLogEntry) {
+			requestLogger(entry.RequestID).debugf("%s %s %s %d %d %v", entry.RemoteAddr, entry.Method, entry.Path, entry.Status, entry.Bytes, entry.Duration)
+		},
+		"json": func(entry accessLogEntry) {
+			if currentLogLevel < levelDebug {
+				return
+			}
+			b, err := json.Marshal(entry)
+			if err != nil {
+				errorf("Unable to encode access log entry %+v: %v", entry, err)
+				return
+			}
+			b = append(b, '\n')
+			log.Writer().Write(b)
+		},
+	}
+)
+
+type accessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remoteAddr"`
+	RequestID  string        `json:"requestID,omitempty"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// statusWriter records the status and size of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logRequests wraps handler to log every request using the given log format.
+func logRequests(logFormat string, handler http.Handler) http.Handler {
+	logEntry := logFormats[logFormat]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		handler.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		logEntry(accessLogEntry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			RequestID:  requestID(r),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     sw.status,
+			Bytes:      sw.bytes,
+			Duration:   time.Since(start),
+		})
+	})
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogIsDebug(t *testing.T) {
+	buf := &bytes.Buffer{}
+	oldWriter, oldLevel := log.Writer(), currentLogLevel
+	log.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetOutput(oldWriter)
+		currentLogLevel = oldLevel
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for format := range logFormats {
+		for _, tc := range []struct {
+			level  logLevel
+			logged bool
+		}{
+			{levelInfo, false},
+			{levelDebug, true},
+		} {
+			buf.Reset()
+			currentLogLevel = tc.level
+			serve(logRequests(format, handler), http.MethodGet, "/requested", nil)
+			if got := strings.Contains(buf.String(), "/requested"); got != tc.logged {
+				t.Errorf("with the %s format at level %d, logged %q", format, tc.level, buf)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// aclFileName is the file listing the users allowed in a directory and
+	// everything below it, one per line. * allows everyone, also those who
+	// haven't logged in. Directories without one inherit the list of their
+	// parent, and when no directory up to the mount has one, everyone who
+	// logged in is allowed. ACL files are only used with -auth, and are
+	// never listed or served.
+	aclFileName = ".mediaweb-acl"
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+)
+
+// userKey is the request context key of the user who logged in.
+type userKey struct{}
+
+// requestUser returns the user who made r, or "" if they didn't log in.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// requiresLogin returns whether urlPath is outside the directories ACLs
+// control, and therefore only served to users who logged in.
+func requiresLogin(urlPath string) bool {
+	return isRoute(urlPath, davPrefix) || isRoute(urlPath, searchPrefix) || urlPath == recentPrefix || urlPath == versionPrefix
+}
+
+// readACL returns the users allowed in dir by its ACL file, and whether it
+// has one.
+func readACL(dir string) (map[string]bool, bool, error) {
+	f, err := openFile(filepath.Join(dir, aclFileName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	users := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		users[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return users, true, nil
+}
+
+// aclAllows returns nil if users allows user, an error wrapping
+// errUnauthorized if they have to log in first, and an error wrapping
+// fs.ErrPermission otherwise.
+func aclAllows(users map[string]bool, user string, dir string) error {
+	if users["*"] || (user != "" && users[user]) {
+		return nil
+	}
+	if user == "" {
+		return fmt.Errorf("%w: log in to see %q", errUnauthorized, dir)
+	}
+	return fmt.Errorf("%w: %q may not see %q", fs.ErrPermission, user, dir)
+}
+
+// checkAccess returns nil if the user of opts may see realPath, inside the
+// mount directory dir, according to the closest ACL file above it.
+func checkAccess(dir string, realPath string, opts options) error {
+	if opts.creds == nil {
+		return nil
+	}
+	current := realPath
+	if info, err := os.Stat(realPath); err != nil || !info.IsDir() {
+		current = filepath.Dir(realPath)
+	}
+	if !isInside(dir, current) {
+		current = dir
+	}
+	for {
+		users, found, err := readACL(current)
+		if err != nil {
+			return err
+		}
+		if found {
+			return aclAllows(users, opts.user, current)
+		}
+		if current == dir {
+			break
+		}
+		current = filepath.Dir(current)
+	}
+	if opts.user == "" {
+		return fmt.Errorf("%w: log in to see %q", errUnauthorized, realPath)
+	}
+	return nil
+}
+
+// mayEnter returns whether the user of opts may see dir, found while
+// walking a directory they may see, according to the ACL file of dir.
+func mayEnter(dir string, opts options) bool {
+	if opts.creds == nil {
+		return true
+	}
+	users, found, err := readACL(dir)
+	if err != nil {
+		debugf("Not entering %q: %v", dir, err)
+		return false
+	}
+	return !found || aclAllows(users, opts.user, dir) == nil
+}
+
+// withUser returns r with user as the user who made it.
+func withUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
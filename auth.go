@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is checked against the passwords of unknown users, so that they
+// take as long to refuse as known users with wrong passwords.
+const dummyHash = "$2a$10$sv4JotASfBXxUEY/XfKDBeHD1wRM4i6qe8sx/e/PtMu/CuNizMNim"
+
+// credentials maps user names to either plain text passwords or bcrypt
+// hashes, as found in htpasswd files created with `htpasswd -B`.
+type credentials map[string]string
+
+// loadCredentials parses spec, which is either a path to an htpasswd style
+// file with one user:password per line, or a single user:password pair.
+func loadCredentials(spec string) (credentials, error) {
+	result := credentials{}
+	f, err := os.Open(spec)
+	if os.IsNotExist(err) {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is neither a file nor a user:password pair", spec)
+		}
+		result[parts[0]] = parts[1]
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected user:password", spec, lineNumber)
+		}
+		if err := checkHash(parts[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", spec, lineNumber, err)
+		}
+		result[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func isBcrypt(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// cryptReg matches the hashes htpasswd creates with -d.
+var cryptReg = regexp.MustCompile(`^[./0-9A-Za-z]{13}$`)
+
+// checkHash returns an error if password is hashed in a format other than
+// bcrypt, like the MD5, SHA1 and crypt hashes htpasswd creates without -B,
+// since those would otherwise be taken for plain text passwords.
+func checkHash(password string) error {
+	switch {
+	case isBcrypt(password):
+		return nil
+	case strings.HasPrefix(password, "$"), strings.HasPrefix(password, "{SHA}"), cryptReg.MatchString(password):
+		return fmt.Errorf("unsupported password hash, create it with `htpasswd -B`")
+	}
+	return nil
+}
+
+// valid returns whether user and password match the credentials. Passwords
+// are compared in constant time, and unknown users are checked against
+// dummyHash, so that they take as long to refuse as users with bcrypt hashes.
+func (c credentials) valid(user, password string) bool {
+	stored, found := c[user]
+	if !found {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return false
+	}
+	if isBcrypt(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
+// requireAuth wraps handler to refuse requests with invalid Basic Auth
+// credentials, and to remember who made the requests with valid ones.
+// Requests without credentials are passed on, and refused by handlerFunc
+// unless an ACL file lets everyone see what they ask for.
+func requireAuth(creds credentials, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if !creds.valid(user, password) {
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, withUser(r, user))
+	})
+}
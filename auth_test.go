@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadCredentialsRejectsUnsupportedHashes(t *testing.T) {
+	for _, hash := range []string{
+		"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"rqXexS6ZhobKA",
+		"$6$salt$hash",
+	} {
+		spec := filepath.Join(t.TempDir(), "htpasswd")
+		if err := os.WriteFile(spec, []byte("user:"+hash+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadCredentials(spec); err == nil {
+			t.Errorf("%q was accepted", hash)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(spec, []byte("hashed:"+string(hash)+"\n# comment\nplain:secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := loadCredentials(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		user     string
+		password string
+		want     bool
+	}{
+		{"hashed", "secret", true},
+		{"hashed", "wrong", false},
+		{"plain", "secret", true},
+		{"plain", "wrong", false},
+		{"unknown", "secret", false},
+		{"unknown", "", false},
+	} {
+		if got := creds.valid(tc.user, tc.password); got != tc.want {
+			t.Errorf("valid(%q, %q) = %v, wanted %v", tc.user, tc.password, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// basePathKey is the request context key of the path prefix the generated
+// links must start with.
+type basePathKey struct{}
+
+// basePath returns the path prefix mediaweb is reached below for r, like
+// "/media", or "" if it is served at the root.
+func basePath(r *http.Request) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	return base
+}
+
+// cleanBasePath returns prefix as an absolute path without trailing slash,
+// or "" if it is the root.
+func cleanBasePath(prefix string) string {
+	prefix = path.Clean("/" + prefix)
+	if prefix == "/" {
+		return ""
+	}
+	return prefix
+}
+
+// serveBasePath wraps handler to serve it below base, for running behind a
+// reverse proxy that passes requests with the whole path. The prefix is
+// stripped from the request path, and remembered so that the generated links
+// include it. If forwardedPrefix is true, the X-Forwarded-Prefix header of
+// proxies that strip the prefix themselves is added to the links too.
+func serveBasePath(base string, forwardedPrefix bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := base
+		if forwardedPrefix {
+			prefix = cleanBasePath(r.Header.Get("X-Forwarded-Prefix") + base)
+		}
+		if prefix == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		stripped := r.Clone(context.WithValue(r.Context(), basePathKey{}, prefix))
+		if base != "" {
+			if !isRoute(r.URL.Path, base) {
+				httpError(w, stripped, r.URL.Path+" is outside base path "+base, http.StatusNotFound)
+				return
+			}
+			stripped.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, base), "/")
+			stripped.URL.RawPath = ""
+		}
+		handler.ServeHTTP(w, stripped)
+	})
+}
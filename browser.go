@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+)
+
+// serverURL returns the URL the server listening at addr is reached at from
+// this machine. Wildcard addresses like 0.0.0.0 and [::] are replaced with
+// localhost, since they can't be connected to. Unix domain sockets have no
+// URL, and give "". basePath is the cleaned -base_path.
+func serverURL(addr net.Addr, secure bool, basePath string) string {
+	if addr.Network() != "tcp" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + basePath + "/"
+}
+
+// openBrowser opens link in the default browser of the desktop.
+func openBrowser(link string) {
+	if err := browserCommand(link).Start(); err != nil {
+		errorf("Unable to open %s in a browser: %v", link, err)
+	}
+}
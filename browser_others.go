@@ -0,0 +1,10 @@
+//go:build !windows && !darwin
+
+package main
+
+import "os/exec"
+
+// browserCommand returns the command opening link in the default browser.
+func browserCommand(link string) *exec.Cmd {
+	return exec.Command("xdg-open", link)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestServerURL(t *testing.T) {
+	for _, tc := range []struct {
+		addr     string
+		secure   bool
+		basePath string
+		want     string
+	}{
+		{"0.0.0.0:8080", false, "", "http://localhost:8080/"},
+		{"[::]:8080", false, "", "http://localhost:8080/"},
+		{"[::1]:8080", true, "/media", "https://[::1]:8080/media/"},
+		{"127.0.0.1:80", false, "", "http://127.0.0.1:80/"},
+	} {
+		addr, err := net.ResolveTCPAddr("tcp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := serverURL(addr, tc.secure, tc.basePath); got != tc.want {
+			t.Errorf("serverURL(%q) = %q, wanted %q", tc.addr, got, tc.want)
+		}
+	}
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("unable to listen on IPv6: %v", err)
+	}
+	defer listener.Close()
+	want := fmt.Sprintf("http://[::1]:%d/", listener.Addr().(*net.TCPAddr).Port)
+	if got := serverURL(listener.Addr(), false, ""); got != want {
+		t.Errorf("serverURL of a listener on [::1]:0 = %q, wanted %q", got, want)
+	}
+}
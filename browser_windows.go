@@ -0,0 +1,8 @@
+package main
+
+import "os/exec"
+
+// browserCommand returns the command opening link in the default browser.
+func browserCommand(link string) *exec.Cmd {
+	return exec.Command("rundll32", "url.dll,FileProtocolHandler", link)
+}
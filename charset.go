@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	// charsetSniffSize is how much of a downloaded text file is looked at to
+	// tell its charset.
+	charsetSniffSize = 4096
+)
+
+var (
+	// defaultCharset is set with -default_charset, and used for text that
+	// has no byte order mark and isn't valid UTF-8.
+	defaultCharset encoding.Encoding = charmap.Windows1252
+)
+
+// charsetOf returns the encoding of the text that starts with prefix, which
+// is all of the text if complete is true. Text with a byte order mark is in
+// the encoding it marks, and text that is valid UTF-8 is assumed to be UTF-8,
+// since other encodings rarely happen to be.
+func charsetOf(prefix []byte, complete bool) encoding.Encoding {
+	switch {
+	case bytes.HasPrefix(prefix, []byte{0xef, 0xbb, 0xbf}):
+		return unicode.UTF8
+	case bytes.HasPrefix(prefix, []byte{0xff, 0xfe}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case bytes.HasPrefix(prefix, []byte{0xfe, 0xff}):
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+	if !complete {
+		// The prefix may end in the middle of a character.
+		for i := 1; i < utf8.UTFMax && i <= len(prefix); i++ {
+			if utf8.RuneStart(prefix[len(prefix)-i]) {
+				if !utf8.FullRune(prefix[len(prefix)-i:]) {
+					prefix = prefix[:len(prefix)-i]
+				}
+				break
+			}
+		}
+	}
+	if utf8.Valid(prefix) {
+		return unicode.UTF8
+	}
+	return defaultCharset
+}
+
+// charsetName returns the name of enc to use in Content-Type headers.
+func charsetName(enc encoding.Encoding) string {
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		return "utf-8"
+	}
+	return name
+}
+
+// sniffCharset returns the name of the charset of the text file f, judging
+// by its start, and leaves f at its start.
+func sniffCharset(f io.ReadSeeker) (string, error) {
+	prefix, err := io.ReadAll(io.LimitReader(f, charsetSniffSize))
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return charsetName(charsetOf(prefix, len(prefix) < charsetSniffSize)), nil
+}
+
+// toUTF8 returns content, which is all of a text, converted to UTF-8 without
+// a byte order mark.
+func toUTF8(content []byte) ([]byte, error) {
+	decoded, err := charsetOf(content, true).NewDecoder().Bytes(content)
+	if err != nil {
+		return nil, err
+	}
+	// Decoding keeps the byte order mark, which is U+FEFF in UTF-8.
+	return bytes.TrimPrefix(decoded, []byte("\ufeff")), nil
+}
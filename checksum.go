@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	checksumPrefix = "/_checksum"
+)
+
+var (
+	// checksumJobs limits how many files are hashed at once, since hashing
+	// reads whole files. It is sized with -max_checksum_jobs.
+	checksumJobs = make(chan struct{}, runtime.NumCPU())
+)
+
+// fileChecksums are the checksums of a file, in hex. MD5 is only there for
+// tools that don't know SHA-256, and shouldn't be trusted on its own.
+type fileChecksums struct {
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+}
+
+// checksumCall is a file being hashed, so that requests for its checksums
+// meanwhile wait for them rather than hash it again.
+type checksumCall struct {
+	size      int64
+	modTime   time.Time
+	done      chan struct{}
+	checksums fileChecksums
+	err       error
+}
+
+type checksumCacheEntry struct {
+	path      string
+	size      int64
+	modTime   time.Time
+	checksums fileChecksums
+}
+
+// checksumCache remembers the checksums of files, since hashing big files
+// reads all of them. Like probeCache, entries are invalidated when the size
+// or modification time of the file changes, and the least recently used
+// entries are evicted when the cache is full.
+type checksumCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	hashing map[string]*checksumCall
+}
+
+func newChecksumCache(size int) *checksumCache {
+	return &checksumCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		hashing: map[string]*checksumCall{},
+	}
+}
+
+// hashFile returns the checksums of the file at path, read in one pass. It
+// waits for a slot in checksumJobs first. Reading a large file takes long, so
+// it is held while hashed.
+func hashFile(path string) (fileChecksums, error) {
+	checksumJobs <- struct{}{}
+	defer func() { <-checksumJobs }()
+	f, err := openHeldFile(path)
+	if err != nil {
+		return fileChecksums{}, err
+	}
+	defer f.Close()
+	sha256Hash := sha256.New()
+	md5Hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha256Hash, md5Hash), f); err != nil {
+		return fileChecksums{}, err
+	}
+	return fileChecksums{
+		SHA256: hex.EncodeToString(sha256Hash.Sum(nil)),
+		MD5:    hex.EncodeToString(md5Hash.Sum(nil)),
+	}, nil
+}
+
+// checksums returns the checksums of the file at path, described by info.
+// Requests for a file that is already being hashed wait for that instead.
+func (c *checksumCache) checksums(path string, info os.FileInfo) (fileChecksums, error) {
+	c.lock.Lock()
+	if elem, found := c.entries[path]; found {
+		cached := elem.Value.(*checksumCacheEntry)
+		if cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+			c.order.MoveToFront(elem)
+			c.lock.Unlock()
+			return cached.checksums, nil
+		}
+		c.order.Remove(elem)
+		delete(c.entries, path)
+	}
+	if call, found := c.hashing[path]; found && call.size == info.Size() && call.modTime.Equal(info.ModTime()) {
+		c.lock.Unlock()
+		<-call.done
+		return call.checksums, call.err
+	}
+	call := &checksumCall{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		done:    make(chan struct{}),
+	}
+	c.hashing[path] = call
+	c.lock.Unlock()
+
+	checksums, err := hashFile(path)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	call.checksums, call.err = checksums, err
+	close(call.done)
+	if c.hashing[path] == call {
+		delete(c.hashing, path)
+	}
+	// Unlike probe failures, read errors are usually temporary, so they
+	// aren't remembered.
+	if err != nil || c.size < 1 {
+		return checksums, err
+	}
+	if elem, found := c.entries[path]; found {
+		c.order.Remove(elem)
+	}
+	c.entries[path] = c.order.PushFront(&checksumCacheEntry{
+		path:      path,
+		size:      info.Size(),
+		modTime:   info.ModTime(),
+		checksums: checksums,
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*checksumCacheEntry).path)
+	}
+	return checksums, nil
+}
+
+// handleChecksum responds with the checksums of the file given by the path
+// parameter as JSON, so that downloads can be verified.
+func handleChecksum(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "checksum")
+	if opts.checksums == nil {
+		httpError(w, r, "checksums are disabled, enable them with -checksums", http.StatusNotFound)
+		return
+	}
+	realPath, err := resolveURLPath(path.Join("/", r.URL.Query().Get("path")), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		httpError(w, r, fmt.Sprintf("%q is not a regular file", r.URL.Query().Get("path")), 400)
+		return
+	}
+	checksums, err := opts.checksums.checksums(realPath, info)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(checksums); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
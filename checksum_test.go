@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChecksumsAreHashedOnce(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("mediaweb", 1<<16)
+	writeFiles(t, dir, map[string]string{"movie.mp4": content})
+	sum := sha256.Sum256([]byte(content))
+	want := hex.EncodeToString(sum[:])
+	opts := testOptions(t, dir)
+	opts.checksums = newChecksumCache(10)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	oldJobs := checksumJobs
+	checksumJobs = make(chan struct{}, 1)
+	t.Cleanup(func() {
+		checksumJobs = oldJobs
+	})
+	// Hashing waits for the only slot while the requests pile up.
+	checksumJobs <- struct{}{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(handler, http.MethodGet, checksumPrefix+"?path=/movie.mp4", nil)
+			got := fileChecksums{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.SHA256 != want {
+				t.Errorf("got %d %s: %v", w.Code, w.Body, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	opts.checksums.lock.Lock()
+	hashing := len(opts.checksums.hashing)
+	opts.checksums.lock.Unlock()
+	if hashing != 1 {
+		t.Errorf("%d hashes were started, wanted 1", hashing)
+	}
+	if len(checksumJobs) != 1 {
+		t.Errorf("%d slots are taken, wanted only ours", len(checksumJobs))
+	}
+	<-checksumJobs
+	wg.Wait()
+}
+
+func TestChecksumsDontTakeOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"movie.mp4": "movie"})
+	opts := testOptions(t, dir)
+	opts.checksums = newChecksumCache(10)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	limitOpenFiles(t, 1)
+	openFiles.acquire()
+	defer openFiles.release()
+	code := make(chan int, 1)
+	go func() {
+		code <- serve(handler, http.MethodGet, checksumPrefix+"?path=/movie.mp4", nil).Code
+	}()
+	select {
+	case got := <-code:
+		if got != 200 {
+			t.Errorf("got %d", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hashing waited for openFiles")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+var (
+	// compressibleTypes are the content types worth compressing. Media is
+	// already compressed, and is never compressed again.
+	compressibleTypes = map[string]bool{
+		"text/html":              true,
+		"text/plain":             true,
+		"text/css":               true,
+		"text/vtt":               true,
+		"text/javascript":        true,
+		"application/json":       true,
+		"application/javascript": true,
+		"image/svg+xml":          true,
+	}
+
+	// encoders are the supported content encodings, most preferred first.
+	// Adding an encoding only needs an entry here.
+	encoders = []encoder{
+		{
+			name: "br",
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+			},
+		},
+		{
+			name: "gzip",
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(w), nil
+			},
+		},
+		{
+			name: "deflate",
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(w, flate.DefaultCompression)
+			},
+		},
+	}
+)
+
+// encoder is a content encoding responses can be compressed with.
+type encoder struct {
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// acceptedEncodings returns the encodings accepted by the Accept-Encoding
+// header, excluding those explicitly refused with q=0.
+func acceptedEncodings(header string) map[string]bool {
+	result := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+		accepted := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && q == 0 {
+					accepted = false
+				}
+			}
+		}
+		if encoding != "" && accepted {
+			result[encoding] = true
+		}
+	}
+	return result
+}
+
+// compressWriter buffers the first minSize bytes of a response, and then
+// compresses it if the content type is compressible.
+type compressWriter struct {
+	http.ResponseWriter
+	encoder    encoder
+	minSize    int
+	buf        []byte
+	status     int
+	decided    bool
+	compressor io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+// decide writes the headers, compressing the response if compress is true
+// and the response is suitable for it, and writes the buffered bytes.
+func (c *compressWriter) decide(compress bool) error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	header := c.Header()
+	if header.Get("Content-Type") == "" && len(c.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	// Content-Range counts bytes of the uncompressed content, so partial
+	// responses, including multipart/byteranges, are sent as they are.
+	if compress && compressibleTypes[mediaType] && header.Get("Content-Encoding") == "" && c.status != http.StatusNoContent && c.status != http.StatusNotModified && c.status != http.StatusPartialContent {
+		header.Set("Content-Encoding", c.encoder.name)
+		header.Del("Content-Length")
+		var err error
+		if c.compressor, err = c.encoder.newWriter(c.ResponseWriter); err != nil {
+			return err
+		}
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	buf := c.buf
+	c.buf = nil
+	_, err := c.write(buf)
+	return err
+}
+
+func (c *compressWriter) write(b []byte) (int, error) {
+	if c.compressor != nil {
+		return c.compressor.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.decided {
+		return c.write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= c.minSize {
+		if err := c.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends what has been written so far to the client, deciding whether
+// to compress the response if that isn't decided yet.
+func (c *compressWriter) Flush() {
+	if !c.decided {
+		if err := c.decide(true); err != nil {
+			return
+		}
+	}
+	if flusher, ok := c.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Close writes responses smaller than minSize uncompressed, and finishes
+// compressed responses.
+func (c *compressWriter) Close() error {
+	if !c.decided {
+		if err := c.decide(false); err != nil {
+			return err
+		}
+	}
+	if c.compressor != nil {
+		return c.compressor.Close()
+	}
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// compressResponses wraps handler to compress text responses of at least
+// minSize bytes with the most preferred of the encoders the client accepts.
+// Downloads, thumbnails and transcoded videos are media, and are never
+// compressed. Neither are event streams, which must reach the client at once.
+func compressResponses(minSize int, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isRoute(r.URL.Path, downloadPrefix) || isRoute(r.URL.Path, thumbPrefix) || isRoute(r.URL.Path, transcodePrefix) || r.URL.Path == eventsPrefix {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+		var cw *compressWriter
+		for _, encoder := range encoders {
+			if accepted[encoder.name] {
+				cw = &compressWriter{
+					ResponseWriter: w,
+					encoder:        encoder,
+					minSize:        minSize,
+				}
+				break
+			}
+		}
+		if cw == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		defer cw.Close()
+		handler.ServeHTTP(cw, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// applyConfig sets the flags named by the keys of the YAML or TOML file at
+// path, unless they were already given on the command line. List values set
+// the flag once per element, like repeating the flag would.
+func applyConfig(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &values)
+	case ".toml":
+		err = toml.Unmarshal(content, &values)
+	default:
+		return fmt.Errorf("unknown config file type %q, expected .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse %q: %v", path, err)
+	}
+
+	givenFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		givenFlags[f.Name] = true
+	})
+	unknownKeys := []string{}
+	for key := range values {
+		if key == "config" || key == "action" || key == "version" || flag.Lookup(key) == nil {
+			unknownKeys = append(unknownKeys, key)
+		}
+	}
+	if len(unknownKeys) > 0 {
+		sort.Strings(unknownKeys)
+		return fmt.Errorf("unknown keys in %q: %v", path, unknownKeys)
+	}
+	for key, value := range values {
+		if givenFlags[key] {
+			continue
+		}
+		elements, isList := value.([]interface{})
+		if !isList {
+			elements = []interface{}{value}
+		}
+		for _, element := range elements {
+			if err := flag.Set(key, fmt.Sprint(element)); err != nil {
+				return fmt.Errorf("invalid value %v for %q in %q: %v", element, key, path, err)
+			}
+		}
+	}
+	return nil
+}
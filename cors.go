@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsOrigins are the origins allowed to make cross origin requests. The
+// origin "*" allows all origins.
+type corsOrigins map[string]bool
+
+// parseCORSOrigins returns the origins in the comma separated list spec.
+func parseCORSOrigins(spec string) corsOrigins {
+	result := corsOrigins{}
+	for _, origin := range strings.Split(spec, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			result[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	return result
+}
+
+// allowCORS wraps handler to add CORS headers to responses on the routes meant
+// for other programs for requests from origins, and to answer their preflight
+// requests. It has to go outside authentication, since preflight requests
+// never carry credentials.
+func allowCORS(origins corsOrigins, handler http.Handler) http.Handler {
+	corsPrefixes := []string{apiPrefix, downloadPrefix, searchPrefix, thumbPrefix, subtitlePrefix, versionPrefix}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := false
+		for _, prefix := range corsPrefixes {
+			if isRoute(r.URL.Path, prefix) {
+				if !origins["*"] {
+					w.Header().Add("Vary", "Origin")
+				}
+				allowed = origin != "" && (origins["*"] || origins[origin])
+				break
+			}
+		}
+		if !allowed {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if origins["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, ETag")
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	davPrefix = "/_dav"
+)
+
+var (
+	// davMethods are the WebDAV methods that don't modify anything.
+	davMethods = map[string]bool{
+		http.MethodOptions: true,
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		"PROPFIND":         true,
+		"LOCK":             true,
+		"UNLOCK":           true,
+	}
+)
+
+// davFS is a read only webdav.FileSystem of the mounts, with the same path
+// containment as the rest of the handlers.
+type davFS struct {
+	opts options
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// realPath returns the path of the file named name on disk.
+func (d davFS) realPath(name string) (string, error) {
+	realPath, err := resolveURLPath(name, d.opts)
+	switch {
+	case errors.Is(err, errNoMount):
+		return "", fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	case errors.Is(err, errOutside):
+		return "", fmt.Errorf("%w: %v", os.ErrPermission, err)
+	}
+	return realPath, err
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	if d.opts.mounts.isVirtualRoot(name) {
+		return d.virtualRoot(), nil
+	}
+	realPath, err := d.realPath(name)
+	if err != nil {
+		return nil, err
+	}
+	// Files stay open while they are downloaded.
+	f, err := openHeldFile(realPath)
+	if err != nil {
+		return nil, err
+	}
+	return davVisibleFile{limitedFile: f, hidden: d.opts.hidden, allowExt: d.opts.allowExt, followSymlinks: d.opts.followSymlinks}, nil
+}
+
+// davVisibleFile is a file whose directory listings only contain the files
+// that are listed, like readEntries lists them.
+type davVisibleFile struct {
+	*limitedFile
+	hidden         bool
+	allowExt       extensions
+	followSymlinks bool
+}
+
+func (f davVisibleFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.limitedFile.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !f.followSymlinks {
+				continue
+			}
+			target, err := os.Stat(filepath.Join(f.Name(), info.Name()))
+			if err != nil {
+				continue
+			}
+			info = target
+		}
+		if isListed(info.Name(), f.hidden) && isAllowed(info.Name(), info.IsDir(), f.allowExt) {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if d.opts.mounts.isVirtualRoot(name) {
+		return d.virtualRoot().Stat()
+	}
+	realPath, err := d.realPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(realPath)
+}
+
+// virtualRoot returns the directory containing the named mounts.
+func (d davFS) virtualRoot() *davRoot {
+	root := &davRoot{}
+	for _, mount := range d.opts.mounts {
+		if checkAccess(mount.dir, mount.dir, d.opts) != nil {
+			continue
+		}
+		if info, err := os.Stat(mount.dir); err == nil {
+			root.infos = append(root.infos, davMountInfo{FileInfo: info, name: mount.name})
+		}
+	}
+	return root
+}
+
+// davMountInfo describes a mount directory by the name of the mount.
+type davMountInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (m davMountInfo) Name() string {
+	return m.name
+}
+
+// davRoot is the virtual directory containing the named mounts.
+type davRoot struct {
+	infos  []os.FileInfo
+	offset int
+}
+
+func (r *davRoot) Close() error {
+	return nil
+}
+
+func (r *davRoot) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("%w: is a directory", os.ErrInvalid)
+}
+
+func (r *davRoot) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		r.offset = 0
+		return 0, nil
+	}
+	return 0, os.ErrInvalid
+}
+
+func (r *davRoot) Readdir(count int) ([]os.FileInfo, error) {
+	rest := r.infos[r.offset:]
+	if count <= 0 {
+		r.offset = len(r.infos)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	r.offset += count
+	return rest[:count], nil
+}
+
+func (r *davRoot) Stat() (os.FileInfo, error) {
+	return davRootInfo{}, nil
+}
+
+func (r *davRoot) Write(b []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// davRootInfo describes the virtual directory containing the named mounts.
+type davRootInfo struct{}
+
+func (davRootInfo) Name() string {
+	return "/"
+}
+
+func (davRootInfo) Size() int64 {
+	return 0
+}
+
+func (davRootInfo) Mode() os.FileMode {
+	return os.ModeDir | 0555
+}
+
+func (davRootInfo) ModTime() time.Time {
+	return startTime
+}
+
+func (davRootInfo) IsDir() bool {
+	return true
+}
+
+func (davRootInfo) Sys() interface{} {
+	return nil
+}
+
+// davHandler returns a read only WebDAV handler of the mounts, served below
+// davPrefix.
+func davHandler(opts options) http.Handler {
+	locks := webdav.NewMemLS()
+	logger := func(r *http.Request, err error) {
+		if err != nil {
+			logger(r).debugf("WebDAV %s %s failed: %v", r.Method, path.Clean(r.URL.Path), err)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Mediaweb-Handler", "dav")
+		if !davMethods[r.Method] {
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND, LOCK, UNLOCK")
+			httpError(w, r, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if opts.noListing && r.Method == "PROPFIND" && r.Header.Get("Depth") != "0" {
+			httpError(w, r, "directory listings are disabled", http.StatusForbidden)
+			return
+		}
+		// ACLs depend on who asks.
+		requestOpts := opts
+		requestOpts.user = requestUser(r)
+		// The prefix is also used for the links in the responses, so it has
+		// to include the base path.
+		base := basePath(r)
+		dav := &webdav.Handler{
+			Prefix:     base + davPrefix,
+			FileSystem: davFS{opts: requestOpts},
+			LockSystem: locks,
+			Logger:     logger,
+		}
+		if base != "" {
+			r = r.Clone(r.Context())
+			r.URL.Path = base + r.URL.Path
+			r.URL.RawPath = ""
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
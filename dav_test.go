@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDAVListsSymlinksLikeListings(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"movie.mp4": "movie"})
+	if err := os.Symlink(filepath.Join(dir, "movie.mp4"), filepath.Join(dir, "linked.mp4")); err != nil {
+		t.Skipf("unable to create symlinks: %v", err)
+	}
+	for _, followSymlinks := range []bool{false, true} {
+		opts := testOptions(t, dir)
+		opts.webdav = true
+		opts.followSymlinks = followSymlinks
+		handler := http.HandlerFunc(handlerFunc(opts))
+		w := serve(handler, "PROPFIND", davPrefix+"/", http.Header{"Depth": {"1"}})
+		if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "movie.mp4") {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+		if got := strings.Contains(w.Body.String(), "linked.mp4"); got != followSymlinks {
+			t.Errorf("with followSymlinks %v, the WebDAV listing was %s", followSymlinks, w.Body)
+		}
+		// PROPFIND stats every entry again, but other clients of Readdir
+		// don't.
+		f, err := davFS{opts: opts}.OpenFile(context.Background(), "/", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		if got := strings.Contains(strings.Join(names, " "), "linked.mp4"); got != followSymlinks {
+			t.Errorf("with followSymlinks %v, Readdir returned %q", followSymlinks, names)
+		}
+		listed := strings.Contains(serve(handler, http.MethodGet, "/", nil).Body.String(), "linked.mp4")
+		if listed != followSymlinks {
+			t.Errorf("with followSymlinks %v, the listing disagrees with WebDAV", followSymlinks)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+const defaultHostPort = "0.0.0.0:80"
+
+// defaultDir returns the directory to serve when -dir isn't given.
+func defaultDir(wd string) string {
+	return wd
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultHostPort avoids port 80, which Windows users often can't bind
+// without administrator privileges.
+const defaultHostPort = "0.0.0.0:8080"
+
+// defaultDir returns the directory to serve when -dir isn't given. Services
+// start in the system directory, which is never what anyone wants to serve,
+// so the user's home directory is used instead.
+func defaultDir(wd string) string {
+	if systemRoot := os.Getenv("SystemRoot"); systemRoot != "" && isInside(filepath.Clean(systemRoot), wd) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home
+		}
+	}
+	return wd
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yuin/goldmark"
+)
+
+const (
+	// maxDescriptionSize limits how much of a description file is rendered.
+	maxDescriptionSize = 64 * 1024
+)
+
+var (
+	// descriptionFiles are the files describing a directory, in order of
+	// preference.
+	descriptionFiles = []string{".mediaweb.txt", "README.md"}
+)
+
+// readDescription returns the description of the directory at dir, in the
+// mount directory mountDir, as HTML, or an empty string if it has no
+// description file. Description files are only read if they could be served,
+// so symlinks pointing outside mountDir never are, and others only with
+// followSymlinks.
+func readDescription(mountDir string, dir string, followSymlinks bool) (string, error) {
+	for _, name := range descriptionFiles {
+		realPath := filepath.Join(dir, name)
+		if err := checkSymlinks(mountDir, realPath, followSymlinks); errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		f, err := openFile(realPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		content, err := io.ReadAll(io.LimitReader(f, maxDescriptionSize))
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		if content, err = toUTF8(content); err != nil {
+			return "", err
+		}
+		if strings.EqualFold(filepath.Ext(name), ".md") {
+			// Raw HTML in the markdown is omitted, since goldmark defaults
+			// to safe rendering.
+			buf := &bytes.Buffer{}
+			if err := goldmark.Convert(content, buf); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		}
+		return `<p class="plain">` + html.EscapeString(string(content)) + "</p>", nil
+	}
+	return "", nil
+}
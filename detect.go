@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	filetype "gopkg.in/h2non/filetype.v1"
+	"gopkg.in/h2non/filetype.v1/types"
+)
+
+var (
+	// extensionTypes are registered with the mime package unless the system
+	// already knows the extensions, since the built in table lacks most media.
+	extensionTypes = map[string]string{
+		".mkv":  "video/x-matroska",
+		".mp4":  "video/mp4",
+		".m4v":  "video/x-m4v",
+		".webm": "video/webm",
+		".avi":  "video/x-msvideo",
+		".mov":  "video/quicktime",
+		".mp3":  "audio/mpeg",
+		".flac": "audio/flac",
+		".ogg":  "audio/ogg",
+		".m4a":  "audio/mp4",
+		".wav":  "audio/wav",
+		".srt":  "application/x-subrip",
+		".vtt":  "text/vtt",
+		".txt":  "text/plain",
+		".nfo":  "text/plain",
+		".log":  "text/plain",
+	}
+	// hlsTypes are always registered, since system tables often claim .ts
+	// for TypeScript or Qt translations.
+	hlsTypes = map[string]string{
+		".m3u8": hlsPlaylistType,
+		".ts":   "video/mp2t",
+	}
+	// mimeOverrides are set with -mime_overrides, and map lower case
+	// extensions to the MIME types of files with them, regardless of their
+	// content.
+	mimeOverrides = map[string]string{}
+)
+
+const (
+	hlsPlaylistType = "application/vnd.apple.mpegurl"
+)
+
+func init() {
+	for ext, mimeType := range extensionTypes {
+		if mime.TypeByExtension(ext) == "" {
+			if err := mime.AddExtensionType(ext, mimeType); err != nil {
+				panic(err)
+			}
+		}
+	}
+	for ext, mimeType := range hlsTypes {
+		if err := mime.AddExtensionType(ext, mimeType); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// isHLS returns whether fileType is an HLS playlist.
+func isHLS(fileType types.Type) bool {
+	return fileType.MIME.Value == hlsPlaylistType
+}
+
+// isText returns whether fileType is readable as text, which includes
+// subtitles.
+func isText(fileType types.Type) bool {
+	return fileType.MIME.Type == "text" || fileType.MIME.Value == "application/x-subrip"
+}
+
+// isPDF returns whether fileType is a PDF document.
+func isPDF(fileType types.Type) bool {
+	return fileType.MIME.Value == "application/pdf"
+}
+
+// extensions are lower case file extensions, with their dots.
+type extensions map[string]bool
+
+// parseExtensions returns the extensions in the comma separated list spec,
+// with or without dots.
+func parseExtensions(spec string) extensions {
+	result := extensions{}
+	for _, ext := range strings.Split(spec, ",") {
+		if ext = strings.Trim(strings.TrimSpace(ext), "."); ext != "" {
+			result["."+strings.ToLower(ext)] = true
+		}
+	}
+	return result
+}
+
+// allows returns whether the file name has one of the extensions, or e is
+// empty.
+func (e extensions) allows(name string) bool {
+	return len(e) == 0 || e[strings.ToLower(filepath.Ext(name))]
+}
+
+// loadMIMEOverrides returns the extension to MIME type mappings in spec,
+// which is either a comma separated list of ext=type pairs, or the path to a
+// file with one pair per line.
+func loadMIMEOverrides(spec string) (map[string]string, error) {
+	result := map[string]string{}
+	if spec == "" {
+		return result, nil
+	}
+	add := func(pair string) error {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.Trim(parts[0], ".") == "" {
+			return fmt.Errorf("%q is not an ext=type pair", pair)
+		}
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(parts[1]))
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("%q is not a MIME type", parts[1])
+		}
+		result["."+strings.ToLower(strings.Trim(strings.TrimSpace(parts[0]), "."))] = mediaType
+		return nil
+	}
+	f, err := os.Open(spec)
+	if os.IsNotExist(err) {
+		for _, pair := range strings.Split(spec, ",") {
+			if err := add(pair); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := add(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", spec, lineNumber, err)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// detectType returns the type of the file at path, detected from its content
+// or, if that fails, from its extension. Extensions in mimeOverrides are
+// trusted without looking at the content.
+func detectType(path string) (types.Type, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if mediaType, found := mimeOverrides[ext]; found {
+		return types.NewType(strings.TrimPrefix(ext, "."), mediaType), nil
+	}
+	openFiles.acquire()
+	fileType, err := filetype.MatchFile(path)
+	openFiles.release()
+	if err != nil {
+		return fileType, err
+	}
+	if fileType.MIME.Value != "" {
+		return fileType, nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		return types.NewType(strings.TrimPrefix(ext, "."), mediaType), nil
+	}
+	return fileType, nil
+}
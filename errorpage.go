@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+var (
+	errorTemplate = template.Must(loadTemplate("", "error.html"))
+)
+
+// wantsJSON returns whether r is made by a program expecting JSON rather
+// than a browser.
+func wantsJSON(r *http.Request) bool {
+	if isRoute(r.URL.Path, apiPrefix) || r.URL.Path == versionPrefix || r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// httpError replies to r with message and status, like http.Error, but as a
+// JSON object for programs and as a page matching the rest of the UI for
+// browsers.
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// Browsers only ask for a password when told how to send it.
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mediaweb", charset="UTF-8"`)
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		body := map[string]string{
+			"error": message,
+		}
+		if id := requestID(r); id != "" {
+			body["requestID"] = id
+		}
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			logger(r).errorf("Unable to write error %q: %v", message, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := errorTemplate.Execute(w, pageData(r, map[string]interface{}{
+		"status":       status,
+		"statusText":   http.StatusText(status),
+		"message":      message,
+		"requestID":    requestID(r),
+		"searchPrefix": searchPrefix,
+	})); err != nil {
+		logger(r).errorf("Unable to write error %q: %v", message, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	eventsPrefix = "/_events"
+	// eventsKeepAlive is how often idle event streams get a comment, so that
+	// proxies don't close them.
+	eventsKeepAlive = 30 * time.Second
+)
+
+// dirEvent is sent to the clients watching a directory when a file in it
+// changes. Clients only get what happened, not to which file, since they may
+// not be allowed to know it exists.
+type dirEvent struct {
+	Op   string `json:"op"`
+	name string
+}
+
+// dirWatcher shares one fsnotify watcher between all clients, since the
+// number of watchers per user is limited on some platforms. Directories are
+// only watched while some client is subscribed to them.
+type dirWatcher struct {
+	lock        sync.Mutex
+	watcher     *fsnotify.Watcher
+	subscribers map[string]map[chan dirEvent]bool
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	d := &dirWatcher{
+		watcher:     watcher,
+		subscribers: map[string]map[chan dirEvent]bool{},
+	}
+	go d.dispatch()
+	return d, nil
+}
+
+// dispatch sends the events of the watcher to the subscribers of the
+// directories they happened in.
+func (d *dirWatcher) dispatch() {
+	for {
+		select {
+		case event, ok := <-d.watcher.Events:
+			if !ok {
+				return
+			}
+			op := ""
+			switch {
+			case event.Has(fsnotify.Create):
+				op = "create"
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				op = "remove"
+			case event.Has(fsnotify.Write):
+				op = "write"
+			default:
+				continue
+			}
+			d.lock.Lock()
+			for subscriber := range d.subscribers[filepath.Dir(event.Name)] {
+				// Slow clients miss events rather than stall everyone else.
+				select {
+				case subscriber <- dirEvent{Op: op, name: filepath.Base(event.Name)}:
+				default:
+				}
+			}
+			d.lock.Unlock()
+		case err, ok := <-d.watcher.Errors:
+			if !ok {
+				return
+			}
+			errorf("Unable to watch directories: %v", err)
+		}
+	}
+}
+
+// subscribe returns a channel of the events in dir, and a function to call
+// when no longer interested in them.
+func (d *dirWatcher) subscribe(dir string) (chan dirEvent, func(), error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.subscribers[dir]) == 0 {
+		if err := d.watcher.Add(dir); err != nil {
+			return nil, nil, err
+		}
+		d.subscribers[dir] = map[chan dirEvent]bool{}
+	}
+	events := make(chan dirEvent, 16)
+	d.subscribers[dir][events] = true
+	return events, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		delete(d.subscribers[dir], events)
+		if len(d.subscribers[dir]) == 0 {
+			delete(d.subscribers, dir)
+			if err := d.watcher.Remove(dir); err != nil {
+				debugf("Unable to stop watching %q: %v", dir, err)
+			}
+		}
+	}, nil
+}
+
+// handleEvents streams the changes to the directory given by the path
+// parameter as Server-Sent Events, until the client disconnects.
+func handleEvents(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "events")
+	if opts.watcher == nil {
+		httpError(w, r, "watching directories is disabled, enable it with -watch", http.StatusNotFound)
+		return
+	}
+	urlPath := path.Join("/", r.URL.Query().Get("path"))
+	if opts.mounts.isVirtualRoot(urlPath) {
+		httpError(w, r, "the list of mounts never changes", 400)
+		return
+	}
+	realPath, err := resolveURLPath(urlPath, opts)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	events, unsubscribe, err := opts.watcher.subscribe(realPath)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	defer unsubscribe()
+	// The stream lasts as long as the page is open.
+	controller := http.NewResponseController(w)
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event := <-events:
+			// Hidden files never show in the listing, so changes to them
+			// needn't reload it.
+			if !isListed(event.name, opts.hidden) {
+				continue
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				logger(r).errorf("Unable to encode %+v: %v", event, err)
+				return
+			}
+			fmt.Fprintf(w, "event: change\ndata: %s\n\n", b)
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventsDontNameFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions(t, dir)
+	watcher, err := newDirWatcher()
+	if err != nil {
+		t.Skipf("unable to watch directories: %v", err)
+	}
+	opts.watcher = watcher
+	server := httptest.NewServer(http.HandlerFunc(handlerFunc(opts)))
+	defer server.Close()
+	resp, err := http.Get(server.URL + eventsPrefix + "?path=/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+	if err := os.WriteFile(filepath.Join(dir, ".secret"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		t.Fatalf("got %q for a hidden file", line)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.mp4"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-lines:
+		if line != `data: {"op":"create"}` {
+			t.Errorf("got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("got no event for a new file")
+	}
+}
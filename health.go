@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	healthPrefix = "/_health"
+)
+
+var (
+	startTime = time.Now()
+)
+
+// serveHealth answers liveness probes at healthPrefix without touching the
+// file system, and passes all other requests to handler. It goes outside
+// authentication and access logging, so probes neither need credentials nor
+// fill the log.
+func serveHealth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthPrefix {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("X-Mediaweb-Handler", "health")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "ok",
+			"uptime": time.Since(startTime).Seconds(),
+		}); err != nil {
+			httpError(w, r, err.Error(), 500)
+			return
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelInfo
+	levelDebug
+)
+
+var (
+	logLevels = map[string]logLevel{
+		"error": levelError,
+		"info":  levelInfo,
+		"debug": levelDebug,
+	}
+	currentLogLevel = levelInfo
+)
+
+// logFile returns a writer appending to the log file at path. If maxSize, in
+// megabytes, is positive the file is rotated when it grows larger, keeping
+// maxBackups old files for maxAge days. Zero keeps them all.
+func logFile(path string, maxSize int, maxBackups int, maxAge int) (io.Writer, error) {
+	// Opening the file reports mistakes at startup, where lumberjack would
+	// only fail when logging.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize < 1 {
+		return f, nil
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+	}, nil
+}
+
+func logAt(level logLevel, format string, args ...interface{}) {
+	if currentLogLevel >= level {
+		log.Printf(format, args...)
+	}
+}
+
+func errorf(format string, args ...interface{}) {
+	logAt(levelError, format, args...)
+}
+
+func infof(format string, args ...interface{}) {
+	logAt(levelInfo, format, args...)
+}
+
+func debugf(format string, args ...interface{}) {
+	logAt(levelDebug, format, args...)
+}
@@ -1,214 +1,1223 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"text/template"
+	"time"
 
-	filetype "gopkg.in/h2non/filetype.v1"
+	"gopkg.in/h2non/filetype.v1/types"
 
 	"github.com/takama/daemon"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 const (
+	apiPrefix = "/_api"
+)
+
+var (
+	// downloadPrefix is set with -download_prefix.
 	downloadPrefix = "/_download"
+
+	// errOutside is returned for paths that would escape their mount.
+	errOutside = errors.New("outside allowed path")
 )
 
 var (
-	dirTemplate = template.Must(template.New("dirTemplate").Funcs(template.FuncMap{
-		"join": filepath.Join,
-	}).Parse(`<html>
-<head>
-<title>{{.title}}</title>
-<style>
-body {
-  font-size: xx-large;
-}
-</style>
-</head>
-<body>
-<ul>
-{{$parent := .parent}}
-{{$dlPrefix := .downloadPrefix}}
-{{range .files}}
-{{if .BuildLink}}
-<li><a href="{{join $parent .Name}}">{{.Name}}</a>{{if .AddDL}} <a href="{{join $dlPrefix $parent .Name}}">DL</a>{{end}}</li>
-{{else}}
-<li>{{join $parent .Name}}</li>
-{{end}}
-{{end}}
-</ul>
-</body>
-</html>
-`))
-	fileTemplate = template.Must(template.New("fileTemplate").Funcs(template.FuncMap{
-		"join": filepath.Join,
-	}).Parse(`<head>
-  <link href="http://vjs.zencdn.net/6.4.0/video-js.css" rel="stylesheet">
-
-  <!-- If you'd like to support IE8 -->
-  <script src="http://vjs.zencdn.net/ie8/1.1.2/videojs-ie8.min.js"></script>
-</head>
-
-<body>
-  <video id="my-video" class="video-js" controls preload="auto" width="640" height="264"
-  data-setup="{}">
-    <source src="{{join .downloadPrefix .name}}" type='{{.type}}'>
-    <p class="vjs-no-js">
-      To view this video please enable JavaScript, and consider upgrading to a web browser that
-      <a href="http://videojs.com/html5-video-support/" target="_blank">supports HTML5 video</a>
-    </p>
-  </video>
-
-  <script src="http://vjs.zencdn.net/6.4.0/video.js"></script>
-</body>
-`))
+	sortOrders = map[string]func(a, b dirEntry) bool{
+		"name": func(a, b dirEntry) bool {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		},
+		"date": func(a, b dirEntry) bool {
+			return a.ModTime.Before(b.ModTime)
+		},
+		"size": func(a, b dirEntry) bool {
+			return a.Size < b.Size
+		},
+	}
+	// filters decide which files, by the type half of their MIME type, are
+	// listed. Directories are always listed.
+	filters = map[string]func(mimeType string) bool{
+		"all": func(mimeType string) bool {
+			return true
+		},
+		"media": isMedia,
+		"video": func(mimeType string) bool {
+			return mimeType == "video"
+		},
+		"audio": func(mimeType string) bool {
+			return mimeType == "audio"
+		},
+		"image": func(mimeType string) bool {
+			return mimeType == "image"
+		},
+	}
 )
 
+var (
+	indexTemplate    = template.Must(loadTemplate("", "index.html"))
+	dirTemplate      = template.Must(loadTemplate("", "dir.html"))
+	videoTemplate    = template.Must(loadTemplate("", "video.html"))
+	plyrTemplate     = template.Must(loadTemplate("", "video-plyr.html"))
+	nativeTemplate   = template.Must(loadTemplate("", "video-native.html"))
+	imageTemplate    = template.Must(loadTemplate("", "image.html"))
+	audioTemplate    = template.Must(loadTemplate("", "audio.html"))
+	downloadTemplate = template.Must(loadTemplate("", "download.html"))
+	textTemplate     = template.Must(loadTemplate("", "text.html"))
+	pdfTemplate      = template.Must(loadTemplate("", "pdf.html"))
+)
+
+type options struct {
+	mounts   mounts
+	sortBy   string
+	filter   string
+	pageSize int
+
+	// singleFile is the name of the file served when -dir is a file, in
+	// the directory of the only mount.
+	singleFile string
+
+	// user is who made the request, or empty if they didn't log in. It is
+	// only set per request.
+	user string
+
+	// sortDescending reverses sortBy. It is only set per request.
+	sortDescending bool
+	followSymlinks bool
+	hidden         bool
+	allowExt       extensions
+	index          string
+	workers        int
+	webdav         bool
+	noListing      bool
+
+	maxSearchResults int
+	recentLimit      int
+	types            *typeCache
+	probes           *probeCache
+	checksums        *checksumCache
+	thumbDir         string
+	creds            credentials
+
+	tlsCert        string
+	tlsKey         string
+	autocertDomain string
+	autocertCache  string
+
+	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	shutdownTimeout   time.Duration
+	maxConnections    int
+	keepAlive         bool
+	h2c               bool
+
+	logFormat string
+
+	compressMinSize int
+
+	textPreviewMax int64
+
+	transcode bool
+
+	watcher *dirWatcher
+
+	playerName string
+	player     playerAssets
+	ie8        bool
+
+	zipMaxFiles int
+	zipMaxBytes int64
+
+	throttle *throttle
+
+	corsOrigins corsOrigins
+
+	basePath        string
+	forwardedPrefix bool
+	trustedProxies  trustedProxies
+
+	open bool
+}
+
+// page is one page of a directory listing.
+type page struct {
+	Entries []dirEntry `json:"entries"`
+	// Count is the number of entries on the page, and Total the number in
+	// the whole directory.
+	Count int `json:"count"`
+	Total int `json:"total"`
+	Page  int `json:"page"`
+	Pages int `json:"pages"`
+	Prev  int `json:"-"`
+	Next  int `json:"-"`
+}
+
+type breadcrumb struct {
+	Name    string
+	Link    string
+	Current bool
+}
+
 type dirEntry struct {
-	BuildLink bool
-	AddDL bool
-	Name      string
-	Type      string
+	BuildLink bool      `json:"-"`
+	AddDL     bool      `json:"-"`
+	Thumb     bool      `json:"-"`
+	IsDir     bool      `json:"isDir"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+
+	// Duration, in seconds, and Resolution, like 1920x1080, are only known
+	// for video and audio files when -probe is set.
+	Duration   float64 `json:"duration,omitempty"`
+	Resolution string  `json:"resolution,omitempty"`
+
+	// mimeType is the type half of the detected MIME type of files.
+	mimeType string
 }
 
-func handleDir(w http.ResponseWriter, r *http.Request, dir *os.File) {
-	w.Header().Add("X-Mediaweb-Handler", "dir")
+// IsImage returns whether the entry is an image file.
+func (e dirEntry) IsImage() bool {
+	return e.mimeType == "image"
+}
+
+// sortEntries orders entries with directories first, then by the given sort
+// order, reversed if descending, falling back to case insensitive name order
+// for ties.
+func sortEntries(entries []dirEntry, sortBy string, descending bool) {
+	less := sortOrders[sortBy]
+	if descending {
+		less = func(a, b dirEntry) bool {
+			return sortOrders[sortBy](b, a)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+}
+
+// breadcrumbs returns the trail of ancestor directories of urlPath, starting
+// at the root and ending with urlPath itself.
+func breadcrumbs(urlPath string) []breadcrumb {
+	result := []breadcrumb{{Name: "Home", Link: "/"}}
+	link := ""
+	for _, segment := range strings.Split(path.Clean("/"+urlPath), "/") {
+		if segment == "" {
+			continue
+		}
+		link += "/" + url.PathEscape(segment)
+		result = append(result, breadcrumb{Name: segment, Link: link})
+	}
+	result[len(result)-1].Current = true
+	return result
+}
+
+// fileETag returns an ETag for the file described by info, which changes when
+// the size or modification time of the file changes. It is strong, since
+// If-Range only matches strong ETags, and resuming downloads is what it is
+// mostly used for.
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// contentType returns the Content-Type header value for fileType, with
+// charset for text.
+func contentType(fileType types.Type, charset string) string {
+	switch {
+	case fileType.MIME.Value == "":
+		return "application/octet-stream"
+	case fileType.MIME.Type == "text":
+		return fileType.MIME.Value + "; charset=" + charset
+	default:
+		return fileType.MIME.Value
+	}
+}
+
+// isMedia returns whether files of the given MIME type get their own page.
+func isMedia(mimeType string) bool {
+	return mimeType == "video" || mimeType == "audio" || mimeType == "image"
+}
+
+// errorStatus returns the HTTP status to respond with when err prevents
+// serving a path: 404 for paths that don't exist, 403 for paths we may not
+// read and 500 for everything else.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, errNoMount):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, errOutside):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// resolveSafePath returns the absolute path on disk of urlPath, relative to
+// the mount directory dir. An error wrapping errOutside is returned if the
+// path isn't inside dir, like when it climbs out of it with "..".
+func resolveSafePath(dir string, urlPath string) (string, error) {
+	realPath, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(urlPath)))
+	if err != nil {
+		return "", err
+	}
+	if !isInside(dir, realPath) {
+		return "", fmt.Errorf("%w: %q is outside allowed path %q", errOutside, realPath, dir)
+	}
+	return realPath, nil
+}
+
+// resolveURLPath returns the path on disk of urlPath in the mounts. Like all
+// paths served, it has to be inside its mount, also after following symlinks.
+func resolveURLPath(urlPath string, opts options) (string, error) {
+	dir, realPath, err := opts.mounts.root(urlPath)
+	if err != nil {
+		return "", err
+	}
+	if hasUnlistedSegment(realPath, opts.hidden) {
+		return "", fmt.Errorf("%w: %q is hidden", fs.ErrNotExist, urlPath)
+	}
+	if realPath, err = resolveSafePath(dir, realPath); err != nil {
+		return "", err
+	}
+	if err := checkSymlinks(dir, realPath, opts.followSymlinks); err != nil {
+		return "", err
+	}
+	if err := checkAccess(dir, realPath, opts); err != nil {
+		return "", err
+	}
+	if len(opts.allowExt) > 0 {
+		if info, err := os.Stat(realPath); err == nil && !isAllowed(info.Name(), info.IsDir(), opts.allowExt) {
+			return "", fmt.Errorf("%w: the extension of %q isn't allowed", fs.ErrPermission, urlPath)
+		}
+	}
+	return realPath, nil
+}
+
+// isHidden returns whether the file or directory name is hidden, like .git.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// isListed returns whether the file or directory name is listed and served.
+// Hidden files only are with -hidden, given as hidden, and ACL files never
+// are.
+func isListed(name string, hidden bool) bool {
+	return name != aclFileName && (hidden || !isHidden(name))
+}
+
+// isAllowed returns whether the file or directory name may be served. With
+// -allow_ext, given as allowExt, only files with those extensions may, while
+// directories always may.
+func isAllowed(name string, isDir bool, allowExt extensions) bool {
+	return isDir || allowExt.allows(name)
+}
+
+// hasUnlistedSegment returns whether any file or directory in urlPath,
+// relative to its mount, isn't listed.
+func hasUnlistedSegment(urlPath string, hidden bool) bool {
+	for _, segment := range strings.Split(path.Clean("/"+urlPath), "/") {
+		if !isListed(segment, hidden) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipEntry returns what a filepath.WalkDir function should return for d if
+// it is hidden or off limits and shouldn't be walked: nil for files, and
+// filepath.SkipDir for directories to not descend into them.
+func skipEntry(d fs.DirEntry) error {
+	if d.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// checkSymlinks returns an error wrapping fs.ErrPermission if realPath, which
+// must be inside dir, is a symlink or inside a symlinked directory pointing
+// outside dir. Unless follow is set, it also refuses symlinks pointing inside
+// dir.
+func checkSymlinks(dir string, realPath string, follow bool) error {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(realPath)
+	if err != nil {
+		return err
+	}
+	if !isInside(resolvedDir, resolved) {
+		return fmt.Errorf("%w: %q links to %q, outside allowed path %q", fs.ErrPermission, realPath, resolved, dir)
+	}
+	if follow {
+		return nil
+	}
+	rel, err := filepath.Rel(dir, realPath)
+	if err != nil {
+		return err
+	}
+	if filepath.Join(resolvedDir, rel) != resolved {
+		return fmt.Errorf("%w: %q is a symlink and -follow_symlinks is off", fs.ErrPermission, realPath)
+	}
+	return nil
+}
+
+// routes returns the top level paths handled by mediaweb itself rather than
+// by serving files.
+func routes() []string {
+	return []string{downloadPrefix, apiPrefix, thumbPrefix, transcodePrefix, eventsPrefix, zipPrefix, staticPrefix, subtitlePrefix, searchPrefix, recentPrefix, versionPrefix, healthPrefix, davPrefix, checksumPrefix}
+}
+
+// isRoute returns whether urlPath is handled by the route at prefix. Unlike
+// strings.HasPrefix it respects path boundaries, so /_downloads is not
+// handled by /_download.
+func isRoute(urlPath string, prefix string) bool {
+	return urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/")
+}
+
+// warnRouteCollisions logs the files and directories that can't be reached
+// because a route has the same path.
+func warnRouteCollisions(m mounts) {
+	for _, route := range routes() {
+		name := strings.TrimPrefix(route, "/")
+		if len(m) == 1 && m[0].name == "" {
+			if _, err := os.Lstat(filepath.Join(m[0].dir, name)); err == nil {
+				errorf("%q in %q is hidden by the %s route", name, m[0].dir, route)
+			}
+			continue
+		}
+		for _, mount := range m {
+			if mount.name == name {
+				errorf("Mount %q is hidden by the %s route", mount.name, route)
+			}
+		}
+	}
+}
+
+// listsDirectories returns whether the route of urlPath reveals the contents
+// of directories, and so is disabled by -no_listing.
+func listsDirectories(urlPath string) bool {
+	for _, prefix := range []string{apiPrefix, zipPrefix, searchPrefix, recentPrefix, eventsPrefix} {
+		if isRoute(urlPath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInside returns whether realPath is dir or somewhere below it. Unlike
+// filepath.HasPrefix it respects path boundaries, so /media-evil is not inside
+// /media.
+func isInside(dir string, realPath string) bool {
+	dir = filepath.Clean(dir)
+	realPath = filepath.Clean(realPath)
+	if realPath == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(realPath, dir)
+}
+
+// readEntries returns the sorted entries of the directory at dirPath.
+func readEntries(dirPath string, opts options) ([]dirEntry, error) {
+	// The directory is closed before the types of its files are detected,
+	// since that opens them.
+	dir, err := openFile(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	// Readdir returns what it managed to read along with the error, and a
+	// partial listing is more useful than none.
 	infos, err := dir.Readdir(-1)
+	dir.Close()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		if len(infos) == 0 {
+			return nil, err
+		}
+		errorf("Only able to partially read %q: %v", dirPath, err)
 	}
-	entries := []dirEntry{}
+	resolved := make([]os.FileInfo, 0, len(infos))
 	for _, info := range infos {
+		if !isListed(info.Name(), opts.hidden) {
+			continue
+		}
+		// Symlinks are listed as what they point to. Serving them is still
+		// refused if they point outside the mount.
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !opts.followSymlinks {
+				continue
+			}
+			target, err := os.Stat(filepath.Join(dirPath, info.Name()))
+			if err != nil {
+				debugf("Not listing %q: %v", info.Name(), err)
+				continue
+			}
+			info = target
+		}
+		if !isAllowed(info.Name(), info.IsDir(), opts.allowExt) {
+			continue
+		}
+		resolved = append(resolved, info)
+	}
+	fileTypes, errs := opts.types.matchAll(dirPath, resolved, opts.workers)
+	entries := []dirEntry{}
+	for i, info := range resolved {
 		if info.IsDir() {
 			entries = append(entries, dirEntry{
 				BuildLink: true,
-				AddDL: false,
+				AddDL:     false,
+				IsDir:     true,
 				Name:      info.Name(),
 				Type:      "directory",
+				ModTime:   info.ModTime(),
 			})
 		} else {
-			fileType, err := filetype.MatchFile(filepath.Join(dir.Name(), info.Name()))
-			if err != nil {
-				http.Error(w, err.Error(), 500)
-				return
+			fileType := fileTypes[i]
+			if err := errs[i]; err != nil {
+				errorf("Not listing %q: %v", filepath.Join(dirPath, info.Name()), err)
+				continue
+			}
+			if !filters[opts.filter](fileType.MIME.Type) {
+				continue
 			}
 			entries = append(entries, dirEntry{
-				BuildLink: fileType.MIME.Type == "video",
-				AddDL: fileType.MIME.Type == "video",
+				BuildLink: isMedia(fileType.MIME.Type) || isHLS(fileType) || isText(fileType) || isPDF(fileType),
+				AddDL:     isMedia(fileType.MIME.Type) || isHLS(fileType) || isText(fileType) || isPDF(fileType),
+				Thumb:     fileType.MIME.Type == "video" || fileType.MIME.Type == "image",
+				mimeType:  fileType.MIME.Type,
 				Name:      info.Name(),
 				Type:      fileType.Extension,
+				Size:      info.Size(),
+				ModTime:   info.ModTime(),
 			})
 		}
 	}
-	if err := dirTemplate.Execute(w, map[string]interface{}{
-		"title":  dir.Name(),
-		"files":  entries,
-		"parent": filepath.Join("/", r.URL.Path),
-		"downloadPrefix": downloadPrefix,
-	}); err != nil {
-		http.Error(w, err.Error(), 500)
+	sortEntries(entries, opts.sortBy, opts.sortDescending)
+	return entries, nil
+}
+
+// isGrid returns whether to show entries as a grid of thumbnails rather than
+// a list. Unless view asks for either, the grid is used when most of the
+// files are images.
+func isGrid(view string, entries []dirEntry) bool {
+	switch view {
+	case "grid":
+		return true
+	case "list":
+		return false
+	}
+	files, images := 0, 0
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		files++
+		if entry.mimeType == "image" {
+			images++
+		}
+	}
+	return images*2 > files
+}
+
+// sortOptions returns opts with the sort order overridden by the sort and
+// order query parameters of r.
+func sortOptions(r *http.Request, opts options) (options, error) {
+	if sortBy := r.URL.Query().Get("sort"); sortBy != "" {
+		if _, found := sortOrders[sortBy]; !found {
+			return opts, fmt.Errorf("invalid sort %q", sortBy)
+		}
+		opts.sortBy = sortBy
+	}
+	switch order := r.URL.Query().Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.sortDescending = true
+	default:
+		return opts, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+	return opts, nil
+}
+
+// sortQuery returns the sort and order query parameters of r as a query
+// string starting with ?, or an empty string if there are none, so that
+// links from listings keep their sort order.
+func sortQuery(r *http.Request) string {
+	query := url.Values{}
+	for _, param := range []string{"sort", "order"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			query.Set(param, value)
+		}
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// otherParams returns the query parameters of r except page, for keeping the
+// view and sort order when linking to other pages.
+func otherParams(r *http.Request) string {
+	query := r.URL.Query()
+	query.Del("page")
+	return query.Encode()
+}
+
+// paginate returns the page of entries requested by the page query parameter
+// of r, counting from 1. A pageSize less than 1 puts all entries on one page.
+func paginate(r *http.Request, entries []dirEntry, pageSize int) (*page, error) {
+	if pageSize < 1 {
+		pageSize = len(entries)
+	}
+	result := &page{
+		Total: len(entries),
+		Page:  1,
+		Pages: 1,
+	}
+	if len(entries) > 0 {
+		result.Pages = (len(entries) + pageSize - 1) / pageSize
+	}
+	if pageParam := r.URL.Query().Get("page"); pageParam != "" {
+		var err error
+		if result.Page, err = strconv.Atoi(pageParam); err != nil || result.Page < 1 {
+			return nil, fmt.Errorf("invalid page %q", pageParam)
+		}
+	}
+	start := (result.Page - 1) * pageSize
+	end := start + pageSize
+	if start > len(entries) {
+		start = len(entries)
+	}
+	if end > len(entries) {
+		end = len(entries)
+	}
+	result.Entries = entries[start:end]
+	result.Count = len(result.Entries)
+	if result.Page > 1 {
+		result.Prev = result.Page - 1
+	}
+	if result.Page < result.Pages {
+		result.Next = result.Page + 1
+	}
+	return result, nil
+}
+
+// indexFile returns the path of the index file of dir, and whether -index is
+// set and dir has one.
+func indexFile(dir *os.File, opts options) (string, bool) {
+	if opts.index == "" {
+		return "", false
+	}
+	indexPath := filepath.Join(dir.Name(), opts.index)
+	info, err := os.Lstat(indexPath)
+	return indexPath, err == nil && info.Mode().IsRegular() && opts.allowExt.allows(opts.index)
+}
+
+func handleDir(w http.ResponseWriter, r *http.Request, dir *os.File, opts options) {
+	if opts.noListing {
+		if indexPath, found := indexFile(dir, opts); found {
+			handleIndexFile(w, r, indexPath)
+			return
+		}
+		httpError(w, r, "directory listings are disabled", http.StatusForbidden)
+		return
+	}
+	if r.URL.Query().Get("format") == "m3u" {
+		handlePlaylist(w, r, dir, opts)
 		return
 	}
+	if r.URL.Query().Get("list") == "" {
+		if indexPath, found := indexFile(dir, opts); found {
+			handleIndexFile(w, r, indexPath)
+			return
+		}
+	}
+	w.Header().Add("X-Mediaweb-Handler", "dir")
+	opts, err := sortOptions(r, opts)
+	if err != nil {
+		httpError(w, r, err.Error(), 400)
+		return
+	}
+	entries, err := readEntries(dir.Name(), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	page, err := paginate(r, entries, opts.pageSize)
+	if err != nil {
+		httpError(w, r, err.Error(), 400)
+		return
+	}
+	description := ""
+	if mountDir, _, err := opts.mounts.root(r.URL.Path); err != nil {
+		logger(r).errorf("Unable to find the mount of %q: %v", r.URL.Path, err)
+	} else if description, err = readDescription(mountDir, dir.Name(), opts.followSymlinks); err != nil {
+		logger(r).errorf("Unable to read description of %q: %v", dir.Name(), err)
+	}
+	view := r.URL.Query().Get("view")
+	events := ""
+	if opts.watcher != nil {
+		events = href(basePath(r), eventsPrefix) + "?" + url.Values{"path": {path.Join("/", r.URL.Path)}}.Encode()
+	}
+	data := pageData(r, map[string]interface{}{
+		"title":            path.Join("/", r.URL.Path),
+		"page":             page,
+		"params":           otherParams(r),
+		"sortQuery":        sortQuery(r),
+		"recentPrefix":     recentPrefix,
+		"grid":             isGrid(view, entries),
+		"events":           events,
+		"description":      description,
+		"parent":           path.Join("/", r.URL.Path),
+		"breadcrumbs":      breadcrumbs(r.URL.Path),
+		"downloadPrefix":   downloadPrefix,
+		"thumbPrefix":      thumbPrefix,
+		"thumbPlaceholder": thumbPlaceholder,
+		"searchPrefix":     searchPrefix,
+		"zipPrefix":        zipPrefix,
+		"checksumPrefix":   checksumPrefix,
+		"checksums":        opts.checksums != nil,
+	})
+	// Only the shown page is probed, since ffprobe is slow.
+	if dirTemplate.Lookup("dir-row") == nil {
+		// Custom templates from before listings were streamed render the
+		// whole page at once.
+		opts.probes.probeAll(dir.Name(), page.Entries, opts.workers)
+		if err := dirTemplate.Execute(w, data); err != nil {
+			httpError(w, r, err.Error(), 500)
+		}
+		return
+	}
+	probed := opts.probes.probeEach(dir.Name(), page.Entries, opts.workers)
+	if err := dirTemplate.ExecuteTemplate(w, "dir-header", data); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	controller := http.NewResponseController(w)
+	controller.Flush()
+	for index := range page.Entries {
+		<-probed[index]
+		if r.Context().Err() != nil {
+			return
+		}
+		row := map[string]interface{}{}
+		for key, value := range data {
+			row[key] = value
+		}
+		row["index"] = index
+		row["entry"] = page.Entries[index]
+		if err := dirTemplate.ExecuteTemplate(w, "dir-row", row); err != nil {
+			logger(r).errorf("Unable to render %q in %q: %v", page.Entries[index].Name, dir.Name(), err)
+			panic(http.ErrAbortHandler)
+		}
+		controller.Flush()
+	}
+	if err := dirTemplate.ExecuteTemplate(w, "dir-footer", data); err != nil {
+		logger(r).errorf("Unable to render %q: %v", dir.Name(), err)
+		panic(http.ErrAbortHandler)
+	}
 }
 
-func handleFile(w http.ResponseWriter, r *http.Request, f *os.File) {
-	w.Header().Add("X-Mediaweb-Handler", "file")
-	fileType, err := filetype.MatchFile(f.Name())
+// handleIndexFile serves the index file at indexPath in place of the listing
+// of its directory.
+func handleIndexFile(w http.ResponseWriter, r *http.Request, indexPath string) {
+	w.Header().Add("X-Mediaweb-Handler", "indexfile")
+	// Relative links in the index file only work below the directory.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		target := path.Base(r.URL.Path) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	f, err := openFile(indexPath)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		httpError(w, r, err.Error(), errorStatus(err))
 		return
 	}
-	w.Header().Add("X-Mediaweb-Type", fmt.Sprintf("%+v", fileType))
-	if err := fileTemplate.Execute(w, map[string]interface{}{
-		"downloadPrefix": downloadPrefix,
-		"name":           filepath.Join("/", r.URL.Path),
-		"type":           fileType.MIME.Value,
-	}); err != nil {
-		http.Error(w, err.Error(), 500)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
 		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
 }
 
-func handleDownload(w http.ResponseWriter, r *http.Request, dir string) {
-	w.Header().Add("X-Mediaweb-Handler", "download")
-	realPath, err := filepath.Rel(downloadPrefix, r.URL.Path)
+// handleIndex renders the landing page listing the named mounts.
+func handleIndex(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "index")
+	entries := opts.mounts.entries(opts)
+	if len(entries) == 0 && opts.creds != nil && opts.user == "" {
+		httpError(w, r, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	links := []breadcrumb{}
+	for _, entry := range entries {
+		links = append(links, breadcrumb{
+			Name: entry.Name,
+			Link: "/" + url.PathEscape(entry.Name),
+		})
+	}
+	if err := indexTemplate.Execute(w, pageData(r, map[string]interface{}{
+		"version":      version,
+		"mounts":       links,
+		"searchPrefix": searchPrefix,
+	})); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
+
+func handleFile(w http.ResponseWriter, r *http.Request, f *os.File, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "file")
+	fileType, err := detectType(f.Name())
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		httpError(w, r, err.Error(), 500)
 		return
 	}
-	realPath, err = filepath.Abs(filepath.Join(dir, realPath))
+	w.Header().Add("X-Mediaweb-Type", fmt.Sprintf("%+v", fileType))
+	findRenderer(fileType)(w, r, f, fileType, opts)
+}
+
+func handleDownload(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "download")
+	realPath, err := resolveURLPath(strings.TrimPrefix(r.URL.Path, downloadPrefix), opts)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		httpError(w, r, err.Error(), errorStatus(err))
 		return
 	}
-	if !filepath.HasPrefix(realPath, dir) {
-		http.Error(w, fmt.Sprintf("%q is outside allowed path %q", realPath, dir), 400)
+	// Pipes and devices are checked before they are opened, since opening
+	// them can block, and reading them might never end.
+	if info, err := os.Stat(realPath); err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	} else if info.IsDir() {
+		httpError(w, r, fmt.Sprintf("%q is a directory", realPath), 400)
+		return
+	} else if !info.Mode().IsRegular() {
+		httpError(w, r, fmt.Sprintf("%q is not a regular file", realPath), 403)
 		return
 	}
-	fileType, err := filetype.MatchFile(realPath)
+	fileType, err := detectType(realPath)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		httpError(w, r, err.Error(), errorStatus(err))
 		return
 	}
-	w.Header().Add("Content-Type", fmt.Sprintf("%+v", fileType.MIME.Value))
-	f, err := os.Open(realPath)
+	w.Header().Set("Content-Type", contentType(fileType, "utf-8"))
+	// Downloads keep their files open for as long as they take.
+	f, err := openHeldFile(realPath)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		httpError(w, r, err.Error(), errorStatus(err))
 		return
 	}
 	defer f.Close()
-	if _, err := io.Copy(w, f); err != nil {
-		http.Error(w, err.Error(), 500)
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
 		return
 	}
+	// Streaming a large video takes longer than any sensible write timeout,
+	// so downloads are exempt from it.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	// The file might have been replaced since it was checked.
+	if !info.Mode().IsRegular() {
+		httpError(w, r, fmt.Sprintf("%q is not a regular file", realPath), 403)
+		return
+	}
+	// Files are shown by the browser, so that players and viewers can load
+	// them, unless ?download=1 asks to save them. Either way they keep their
+	// names.
+	disposition := "inline"
+	if r.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": info.Name(),
+	}))
+	w.Header().Set("ETag", fileETag(info))
+	if fileType.MIME.Type == "text" {
+		charset, err := sniffCharset(f)
+		if err != nil {
+			httpError(w, r, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", contentType(fileType, charset))
+	}
+	// ServeContent handles Range, If-Range, HEAD and conditional requests for
+	// us, and seeks in the file instead of reading it into memory. Requests for
+	// several ranges get them all in a multipart/byteranges response.
+	http.ServeContent(opts.throttle.writer(w, r), r, info.Name(), info.ModTime(), f)
 }
 
-func handlerFunc(dir string) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if filepath.HasPrefix(r.URL.Path, "/_download") {
-			handleDownload(w, r, dir)
+func handleAPI(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "api")
+	opts, err := sortOptions(r, opts)
+	if err != nil {
+		httpError(w, r, err.Error(), 400)
+		return
+	}
+	realPath := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	var entries []dirEntry
+	dirName := ""
+	if opts.mounts.isVirtualRoot(realPath) {
+		if entries = opts.mounts.entries(opts); len(entries) == 0 && opts.creds != nil && opts.user == "" {
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
 			return
 		}
-		realPath, err := filepath.Abs(filepath.Join(dir, r.URL.Path))
+	} else {
+		realPath, err := resolveURLPath(realPath, opts)
 		if err != nil {
-			http.Error(w, err.Error(), 400)
+			httpError(w, r, err.Error(), errorStatus(err))
 			return
 		}
-		w.Header().Add("X-Mediaweb-Realpath", realPath)
-		if !filepath.HasPrefix(realPath, dir) {
-			http.Error(w, fmt.Sprintf("%q is outside allowed path %q", realPath, dir), 400)
+		if entries, err = readEntries(realPath, opts); err != nil {
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+		dirName = realPath
+	}
+	page, err := paginate(r, entries, opts.pageSize)
+	if err != nil {
+		httpError(w, r, err.Error(), 400)
+		return
+	}
+	if dirName != "" {
+		opts.probes.probeAll(dirName, page.Entries, opts.workers)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
+
+func handlerFunc(opts options) func(w http.ResponseWriter, r *http.Request) {
+	var dav http.Handler
+	if opts.webdav {
+		dav = davHandler(opts)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		opts := opts
+		opts.user = requestUser(r)
+		if opts.creds != nil && opts.user == "" && requiresLogin(r.URL.Path) {
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if opts.singleFile != "" {
+			urlPath, found := singleFilePath(r.URL.Path, opts.singleFile)
+			if !found {
+				httpError(w, r, fmt.Sprintf("only %q is served", opts.singleFile), http.StatusNotFound)
+				return
+			}
+			if urlPath != r.URL.Path {
+				r = r.Clone(r.Context())
+				r.URL.Path = urlPath
+				r.URL.RawPath = ""
+			}
+		}
+		// WebDAV has methods of its own.
+		if dav != nil && isRoute(r.URL.Path, davPrefix) {
+			dav.ServeHTTP(w, r)
+			return
+		}
+		if opts.noListing && (opts.mounts.isVirtualRoot(r.URL.Path) || listsDirectories(r.URL.Path)) {
+			httpError(w, r, "directory listings are disabled", http.StatusForbidden)
+			return
+		}
+		// Nothing is ever modified, so only reading methods are allowed. Zips
+		// of selected files are the exception, since the selection is posted.
+		if isRoute(r.URL.Path, zipPrefix) && r.Method == http.MethodPost {
+			handleZip(w, r, opts)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if isRoute(r.URL.Path, zipPrefix) {
+				w.Header().Set("Allow", "GET, HEAD, POST")
+			} else {
+				w.Header().Set("Allow", "GET, HEAD")
+			}
+			httpError(w, r, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if isRoute(r.URL.Path, downloadPrefix) {
+			handleDownload(w, r, opts)
+			return
+		}
+		if isRoute(r.URL.Path, apiPrefix) {
+			handleAPI(w, r, opts)
+			return
+		}
+		if isRoute(r.URL.Path, thumbPrefix) {
+			handleThumb(w, r, opts)
+			return
+		}
+		if isRoute(r.URL.Path, transcodePrefix) {
+			handleTranscode(w, r, opts)
+			return
+		}
+		if r.URL.Path == eventsPrefix {
+			handleEvents(w, r, opts)
+			return
+		}
+		if isRoute(r.URL.Path, zipPrefix) {
+			handleZip(w, r, opts)
+			return
+		}
+		if isRoute(r.URL.Path, staticPrefix) {
+			handleStatic(w, r)
+			return
+		}
+		if isRoute(r.URL.Path, subtitlePrefix) {
+			handleSubtitle(w, r, opts)
+			return
+		}
+		if isRoute(r.URL.Path, searchPrefix) {
+			handleSearch(w, r, opts)
+			return
+		}
+		if r.URL.Path == recentPrefix {
+			handleRecent(w, r, opts)
+			return
+		}
+		if r.URL.Path == checksumPrefix {
+			handleChecksum(w, r, opts)
+			return
+		}
+		if r.URL.Path == versionPrefix {
+			handleVersion(w, r)
+			return
+		}
+		if isBrowserRequest(r.URL.Path) {
+			handleBrowserRequest(w, r)
 			return
 		}
-		f, err := os.Open(realPath)
+		if opts.mounts.isVirtualRoot(r.URL.Path) {
+			handleIndex(w, r, opts)
+			return
+		}
+		realPath, err := resolveURLPath(r.URL.Path, opts)
 		if err != nil {
-			http.Error(w, err.Error(), 400)
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+		w.Header().Add("X-Mediaweb-Realpath", realPath)
+		logger(r).debugf("%s %s resolved to %q", r.Method, r.URL.Path, realPath)
+		// Directories stay open while their files are, and files while they
+		// are shown, so they are held.
+		f, err := openHeldFile(realPath)
+		if err != nil {
+			httpError(w, r, err.Error(), errorStatus(err))
 			return
 		}
 		defer f.Close()
 		info, err := f.Stat()
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			httpError(w, r, err.Error(), 500)
 			return
 		}
 		if info.IsDir() {
-			handleDir(w, r, f)
+			handleDir(w, r, f.File, opts)
 		} else {
-			handleFile(w, r, f)
+			handleFile(w, r, f.File, opts)
 		}
 	}
 }
 
-func run(hostPort string, dir string) {
-	if err := http.ListenAndServe(hostPort, http.HandlerFunc(handlerFunc(dir))); err != nil {
-		panic(err)
+// listen listens on the TCP address hostPort, or on the Unix domain socket
+// path if hostPort is unix:path. Stale sockets left behind by crashed
+// processes are removed, and the socket is removed when the listener closes.
+func listen(hostPort string) (net.Listener, error) {
+	socketPath := strings.TrimPrefix(hostPort, "unix:")
+	if socketPath == hostPort {
+		return net.Listen("tcp", hostPort)
+	}
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%v is in use by another process", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", socketPath)
+}
+
+// newHandler returns the handler serving opts, with all the middleware
+// requests pass through.
+func newHandler(opts options) http.Handler {
+	handler := compressResponses(opts.compressMinSize, http.HandlerFunc(handlerFunc(opts)))
+	if opts.creds != nil {
+		handler = requireAuth(opts.creds, handler)
 	}
+	if len(opts.corsOrigins) > 0 {
+		handler = allowCORS(opts.corsOrigins, handler)
+	}
+	if opts.basePath != "" || opts.forwardedPrefix {
+		handler = serveBasePath(opts.basePath, opts.forwardedPrefix, handler)
+	}
+	handler = logRequests(opts.logFormat, handler)
+	handler = assignRequestIDs(handler)
+	if len(opts.trustedProxies) > 0 {
+		handler = trustProxies(opts.trustedProxies, handler)
+	}
+	handler = serveHealth(handler)
+	if opts.h2c {
+		// Without TLS, browsers never use HTTP/2, but reverse proxies can.
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: opts.idleTimeout})
+	}
+	return handler
+}
+
+func run(hostPort string, opts options) error {
+	server := &http.Server{
+		Addr:              hostPort,
+		Handler:           newHandler(opts),
+		ReadHeaderTimeout: opts.readHeaderTimeout,
+		WriteTimeout:      opts.writeTimeout,
+		IdleTimeout:       opts.idleTimeout,
+	}
+	listener, err := listen(hostPort)
+	if err != nil {
+		var syscallErr *os.SyscallError
+		if errors.As(err, &syscallErr) {
+			err = syscallErr.Err
+		}
+		return fmt.Errorf("failed to bind %v: %v", hostPort, err)
+	}
+	if opts.maxConnections > 0 {
+		// Connections beyond the limit wait in the listen queue until others close.
+		listener = netutil.LimitListener(listener, opts.maxConnections)
+	}
+	server.SetKeepAlivesEnabled(opts.keepAlive)
+	served := opts.mounts.String()
+	if opts.singleFile != "" {
+		served = filepath.Join(opts.mounts[0].dir, opts.singleFile)
+	}
+	infof("Serving %v on %v", served, listener.Addr())
+	if opts.open {
+		// The listener already queues connections, so the browser can connect
+		// before the server is serving.
+		if link := serverURL(listener.Addr(), opts.tlsCert != "" || opts.autocertDomain != "", opts.basePath); link != "" {
+			openBrowser(link)
+		}
+	}
+	serve := func() error {
+		switch {
+		case opts.autocertDomain != "":
+			manager := &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(opts.autocertDomain),
+				Cache:      autocert.DirCache(opts.autocertCache),
+			}
+			server.TLSConfig = manager.TLSConfig()
+			return server.ServeTLS(listener, "", "")
+		case opts.tlsCert != "":
+			return server.ServeTLS(listener, opts.tlsCert, opts.tlsKey)
+		default:
+			return server.Serve(listener)
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		infof("Received %v, waiting up to %v for active requests to finish", sig, opts.shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			errorf("Unable to shut down gracefully: %v", err)
+			server.Close()
+		}
+	}
+	return nil
+}
+
+// installArgs returns the arguments the installed service will run with:
+// every flag in commandLine except -action, and unless a config file is
+// used, the directory and address to serve.
+func installArgs(dir string, hostPort string, commandLine map[string]bool) []string {
+	args := []string{}
+	if !commandLine["config"] {
+		args = append(args, "-dir", dir, "-host_port", hostPort)
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if !commandLine[f.Name] {
+			return
+		}
+		switch f.Name {
+		case "action", "open":
+			// Services have no desktop to open a browser on.
+		case "dir", "host_port":
+			if commandLine["config"] {
+				args = append(args, "-"+f.Name+"="+f.Value.String())
+			}
+		case "log_file":
+			// Services don't run in the working directory of the installer.
+			logFile, err := filepath.Abs(f.Value.String())
+			if err != nil {
+				logFile = f.Value.String()
+			}
+			args = append(args, "-"+f.Name+"="+logFile)
+		default:
+			// Boolean flags only take values in the -name=value form.
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
 }
 
 func main() {
@@ -216,16 +1225,113 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	dir := flag.String("dir", wd, "Which directory to serve.")
-	hostPort := flag.String("host_port", "0.0.0.0:80", "Where to serve.")
+	dirs := mounts{}
+	flag.Var(&dirs, "dir", "Which directory to serve. Give more than one directory, either as a comma separated list or by repeating the flag, to serve each as a top level directory. Directories can be named using name=path. Defaults to the working directory.")
+	hostPort := flag.String("host_port", defaultHostPort, "Where to serve, like 0.0.0.0:80 or [::]:80 for IPv6. Use unix:path to serve on a Unix domain socket.")
+	possibleSorts := []string{}
+	for sortBy := range sortOrders {
+		possibleSorts = append(possibleSorts, sortBy)
+	}
+	sort.Strings(possibleSorts)
+	possibleThemes := []string{}
+	for name := range themes {
+		possibleThemes = append(possibleThemes, name)
+	}
+	sort.Strings(possibleThemes)
+	title := flag.String("title", siteTitle, "The name of the site, shown in page titles and on the start page.")
+	themeName := flag.String("theme", defaultTheme, fmt.Sprintf("Color scheme of the pages for visitors that haven't picked one with the theme button. One of %+v.", possibleThemes))
+	open := flag.Bool("open", false, "Whether to open the served directory in the default browser once the server is listening.")
+	probe := flag.Bool("probe", false, "Whether to show the duration and resolution of video and audio files in listings. Requires ffprobe.")
+	checksumsFlag := flag.Bool("checksums", false, "Whether to offer the SHA-256 and MD5 checksums of files at "+checksumPrefix+"?path= and in listings. Hashing reads the whole file, so the results are cached.")
+	charset := flag.String("default_charset", charsetName(defaultCharset), "The charset of text files and subtitles that aren't UTF-8 and have no byte order mark. They are converted to UTF-8 when shown.")
+	mimeOverridesSpec := flag.String("mime_overrides", "", "Comma separated list of ext=type pairs, like mkv=video/x-matroska, or a path to a file with one pair per line, forcing the MIME type of files with those extensions when content sniffing gets them wrong.")
+	cacheSize := flag.Int("cache_size", 10000, "How many detected file types, probed media files and checksums to cache. 0 disables the cache.")
+	workers := flag.Int("workers", 8, "How many files to detect the types of at once when listing a directory.")
+	thumbDir := flag.String("thumb_dir", filepath.Join(os.TempDir(), "mediaweb-thumbs"), "Where to cache generated video and image thumbnails.")
+	sortBy := flag.String("sort", "name", fmt.Sprintf("How to sort directory listings. One of %+v. Listings can override it with ?sort=, and reverse it with ?order=desc.", possibleSorts))
+	recentLimit := flag.Int("recent_limit", 100, fmt.Sprintf("How many files %s lists by default. Overridden by ?limit=.", recentPrefix))
+	possibleFilters := []string{}
+	for filter := range filters {
+		possibleFilters = append(possibleFilters, filter)
+	}
+	sort.Strings(possibleFilters)
+	index := flag.String("index", "", "Name of a file, like index.html, to serve as HTML in place of the listing of directories containing it. The listing is still shown with ?list=1. Empty means always listing directories.")
+	noListing := flag.Bool("no_listing", false, "Whether to refuse to list directories, so that files can only be reached through links to them. Index files are still served, and search, the API, zips and recent files are disabled too.")
+	webdav := flag.Bool("webdav", false, fmt.Sprintf("Whether to serve the directories read only over WebDAV at %s, for mounting them as network drives.", davPrefix))
+	allowExt := flag.String("allow_ext", "", "Comma separated list of file extensions, like mp4,mkv,jpg, to serve. Other files are left out of listings, and requests for them are refused. Empty means all files.")
+	hidden := flag.Bool("hidden", false, "Whether to list and serve hidden files and directories, whose names start with a dot, like .git.")
+	maxOpenFiles := flag.Int("max_open_files", 512, "How many files requests may read at once, to not run out of file descriptors. 0 means no limit.")
+	maxHeldFiles := flag.Int("max_held_files", 512, "How many files and directories requests may keep open at once while listing or sending them. Downloads keep theirs open while they are sent, so this should be well above the number of simultaneous viewers. 0 means no limit.")
+	maxThumbJobs := flag.Int("max_thumb_jobs", runtime.NumCPU(), "How many thumbnails to generate at once. Further thumbnails wait, so that galleries of large images don't run out of memory.")
+	maxChecksumJobs := flag.Int("max_checksum_jobs", runtime.NumCPU(), "How many files to compute checksums of at once. Further requests wait.")
+	followSymlinks := flag.Bool("follow_symlinks", false, "Whether to serve symlinks. Symlinks pointing outside the served directories are never served.")
+	filter := flag.String("filter", "all", fmt.Sprintf("Which files to list in directories, by detected type. Directories are always listed. One of %+v.", possibleFilters))
+	tlsCert := flag.String("tls_cert", "", "Certificate file to serve TLS with. Requires -tls_key.")
+	tlsKey := flag.String("tls_key", "", "Key file to serve TLS with. Requires -tls_cert.")
+	autocertDomain := flag.String("tls_autocert_domain", "", "Domain to serve TLS for using certificates from Let's Encrypt.")
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	autocertCache := flag.String("tls_autocert_cache", filepath.Join(cacheDir, "mediaweb", "autocert"), "Where to cache certificates from Let's Encrypt.")
+	readHeaderTimeout := flag.Duration("read_header_timeout", 10*time.Second, "How long clients may take to send request headers.")
+	writeTimeout := flag.Duration("write_timeout", time.Minute, "How long writing a response may take. Downloads are exempt, since streaming a video takes as long as watching it. 0 means no timeout.")
+	idleTimeout := flag.Duration("idle_timeout", 2*time.Minute, "How long to keep idle keep-alive connections open.")
+	maxConnections := flag.Int("max_connections", 0, "How many connections to serve at once. Further connections wait until others close. 0 means no limit.")
+	h2cFlag := flag.Bool("h2c", false, "Whether to accept HTTP/2 over cleartext connections, for reverse proxies speaking HTTP/2 to mediaweb. HTTP/2 is always offered over TLS.")
+	keepAlive := flag.Bool("keep_alive", true, "Whether to keep idle connections open for reuse, for at most -idle_timeout.")
+	shutdownTimeout := flag.Duration("shutdown_timeout", 30*time.Second, "How long to let active requests finish when shutting down.")
+	possibleLogFormats := []string{}
+	for logFormat := range logFormats {
+		possibleLogFormats = append(possibleLogFormats, logFormat)
+	}
+	sort.Strings(possibleLogFormats)
+	logFormat := flag.String("log_format", "text", fmt.Sprintf("How to format the access log, which is written with -log_level debug. One of %+v.", possibleLogFormats))
+	pageSize := flag.Int("page_size", 1000, "How many entries to show per page of a directory listing. 0 shows all entries on one page.")
+	maxSearchResults := flag.Int("max_search_results", 1000, "How many matches to return from a search at most. 0 means no limit.")
+	ie8 := flag.Bool("ie8", false, "Whether the video.js player loads the shim it needs to work in Internet Explorer 8 from its CDN.")
+	watch := flag.Bool("watch", false, "Whether open listings update themselves when files are added or removed. Each watched directory uses an inotify watch or similar, which some systems have few of.")
+	transcode := flag.Bool("transcode", false, fmt.Sprintf("Whether to offer playing videos browsers can't play converted by ffmpeg, streamed from %s. Uses a lot of CPU.", transcodePrefix))
+	textPreviewMax := flag.Int64("text_preview_max", 1<<20, "How large text files, in bytes, are shown in the page rather than only linked for download.")
+	compressMinSize := flag.Int("compress_min_size", 1024, "How large text responses must be, in bytes, to be compressed.")
+	templatesDir := flag.String("templates", "", "Directory with templates overriding the built in ones. Templates missing from the directory use the built in defaults.")
+	zipMaxFiles := flag.Int("zip_max_files", 10000, "How many files a directory may contain to be downloadable as a zip. 0 means no limit.")
+	zipMaxBytes := flag.Int64("zip_max_bytes", 0, "How many bytes a directory may contain to be downloadable as a zip. 0 means no limit.")
+	maxBandwidth := flag.Int64("max_bandwidth", 0, "How many bytes per second to send at most, shared by all downloads and zips. 0 means no limit.")
+	possiblePlayers := []string{}
+	for name := range players {
+		possiblePlayers = append(possiblePlayers, name)
+	}
+	sort.Strings(possiblePlayers)
+	playerName := flag.String("player", "videojs", fmt.Sprintf("Which player to play videos with. One of %+v. The native player needs no scripts at all.", possiblePlayers))
+	cdn := flag.Bool("cdn", false, "Load the player from its CDN instead of serving the embedded copy.")
+	possibleLogLevels := []string{}
+	for level := range logLevels {
+		possibleLogLevels = append(possibleLogLevels, level)
+	}
+	sort.Strings(possibleLogLevels)
+	level := flag.String("log_level", "info", fmt.Sprintf("How much to log. One of %+v.", possibleLogLevels))
+	logFileFlag := flag.String("log_file", "", "File to append the log to instead of standard error. Empty means standard error.")
+	logMaxSize := flag.Int("log_max_size", 0, "Size in megabytes at which -log_file is rotated. 0 means never.")
+	logMaxBackups := flag.Int("log_max_backups", 5, "How many rotated log files to keep. 0 keeps them all.")
+	logMaxAge := flag.Int("log_max_age", 0, "How many days to keep rotated log files. 0 keeps them regardless of age.")
+	configFile := flag.String("config", "", "YAML or TOML file with flag values. Flags given on the command line override the file.")
+	corsOriginsSpec := flag.String("cors_origins", "", "Comma separated list of origins, like https://example.com, allowed to use the API, downloads, search, thumbnails and subtitles from other sites. * allows all origins. Empty means none.")
+	downloadPrefixFlag := flag.String("download_prefix", downloadPrefix, "Path to serve raw files below. Change it if a top level directory has the same name.")
+	basePathFlag := flag.String("base_path", "", "Path prefix, like /media, to serve everything below when a reverse proxy passes requests with the whole path.")
+	trustedProxiesSpec := flag.String("trusted_proxies", "", "Comma separated list of CIDRs, like 10.0.0.0/8, of reverse proxies whose X-Forwarded-For and X-Real-IP headers tell the client address to log. Only list proxies that overwrite or append to these headers, since anyone else could send them to pose as another client.")
+	forwardedPrefix := flag.Bool("forwarded_prefix", false, "Whether to prefix the links with the X-Forwarded-Prefix header sent by reverse proxies that strip the prefix themselves. Only enable it behind such a proxy.")
+	auth := flag.String("auth", "", "Require Basic Auth with either a user:password pair or a path to an htpasswd style file. Empty means no authentication. A "+aclFileName+" file in a directory lists, one per line, the users who may see it and everything below it, or * for everyone including those who haven't logged in.")
 
 	service, err := daemon.New("mediaweb", "Web server for media files.")
 	if err != nil {
 		log.Fatal("Error: ", err)
 	}
+	// commandLine is the set of flags given on the command line.
+	commandLine := map[string]bool{}
 	actions := map[string]func() (string, error){
 		"install": func() (string, error) {
-			return service.Install("-dir", *dir, "-host_port", *hostPort)
+			return service.Install(installArgs(dirs.String(), *hostPort, commandLine)...)
 		},
 		"remove": func() (string, error) {
 			return service.Remove()
@@ -246,10 +1352,219 @@ func main() {
 	}
 
 	action := flag.String("action", "", fmt.Sprintf("Which action to perform. One of %+v.", possibleActions))
+	printVersion := flag.Bool("version", false, "Print the version of mediaweb and exit.")
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Println(currentBuild())
+		return
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+	if *configFile != "" {
+		if err := applyConfig(*configFile); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+
+	if len(dirs) == 0 {
+		if err := dirs.Set(defaultDir(wd)); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+	// The daemon is checked when installed too, since it can't report
+	// mistakes once it runs in the background.
+	if *action == "" || *action == "install" {
+		if err := dirs.check(); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+	if _, found := sortOrders[*sortBy]; !found {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !strings.HasPrefix(*hostPort, "unix:") {
+		if _, _, err := net.SplitHostPort(*hostPort); err != nil {
+			log.Fatalf("Error: invalid -host_port %q, IPv6 addresses need brackets like [::1]:8080: %v", *hostPort, err)
+		}
+	}
+	downloadPrefix = path.Clean("/" + *downloadPrefixFlag)
+	if downloadPrefix == "/" || strings.Count(downloadPrefix, "/") > 1 {
+		log.Fatal("Error: -download_prefix must be a single path segment, like /_download")
+	}
+	for _, route := range routes()[1:] {
+		if route == downloadPrefix {
+			log.Fatalf("Error: -download_prefix %s is already used by another route", downloadPrefix)
+		}
+	}
+	if _, found := players[*playerName]; !found {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if _, found := filters[*filter]; !found {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !themes[*themeName] {
+		flag.Usage()
+		os.Exit(2)
+	}
+	defaultTheme = *themeName
+	siteTitle = *title
+	if defaultCharset, err = htmlindex.Get(*charset); err != nil {
+		log.Fatalf("Error: unknown -default_charset %q: %v", *charset, err)
+	}
+	openFiles = newFileLimiter(*maxOpenFiles)
+	heldFiles = newFileLimiter(*maxHeldFiles)
+	if *maxThumbJobs < 1 {
+		log.Fatal("Error: -max_thumb_jobs must be at least 1")
+	}
+	thumbJobs = make(chan struct{}, *maxThumbJobs)
+	if *maxChecksumJobs < 1 {
+		log.Fatal("Error: -max_checksum_jobs must be at least 1")
+	}
+	checksumJobs = make(chan struct{}, *maxChecksumJobs)
+	if mimeOverrides, err = loadMIMEOverrides(*mimeOverridesSpec); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	for ext, mimeType := range mimeOverrides {
+		if err := mime.AddExtensionType(ext, mimeType); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+	if _, found := logFormats[*logFormat]; !found {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var found bool
+	if currentLogLevel, found = logLevels[*level]; !found {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *logFileFlag != "" && *action == "" {
+		output, err := logFile(*logFileFlag, *logMaxSize, *logMaxBackups, *logMaxAge)
+		if err != nil {
+			log.Fatal("Error: ", err)
+		}
+		log.SetOutput(output)
+	}
+
+	if *templatesDir != "" {
+		if err := loadTemplates(*templatesDir); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("Error: -tls_cert and -tls_key must be given together")
+	}
+
+	var creds credentials
+	if *auth != "" {
+		if creds, err = loadCredentials(*auth); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+
+	var watcher *dirWatcher
+	if *watch && *action == "" {
+		if watcher, err = newDirWatcher(); err != nil {
+			log.Fatal("Error: ", err)
+		}
+	}
+
+	var probes *probeCache
+	if *probe && *action == "" {
+		probes = newProbeCache(*cacheSize)
+	}
+
+	var checksums *checksumCache
+	if *checksumsFlag {
+		checksums = newChecksumCache(*cacheSize)
+	}
+
+	proxies, err := parseTrustedProxies(*trustedProxiesSpec)
+	if err != nil {
+		log.Fatal("Error: ", err)
+	}
+
 	if *action == "" {
-		run(*hostPort, *dir)
+		var singleFile string
+		if dirs, singleFile = dirs.singleFile(); singleFile == "" {
+			warnRouteCollisions(dirs)
+		}
+		player, local := players[*playerName].assets(*cdn)
+		if !*cdn && !local {
+			infof("The %s player is not embedded in this build, loading it from %s. Run `go generate` before building to embed it.", *playerName, player.JS)
+		}
+		if err := run(*hostPort, options{
+			mounts:   dirs,
+			sortBy:   *sortBy,
+			filter:   *filter,
+			pageSize: *pageSize,
+
+			singleFile: singleFile,
+
+			followSymlinks: *followSymlinks,
+			hidden:         *hidden,
+			allowExt:       parseExtensions(*allowExt),
+			index:          *index,
+			workers:        *workers,
+			webdav:         *webdav,
+			noListing:      *noListing,
+
+			maxSearchResults: *maxSearchResults,
+			recentLimit:      *recentLimit,
+			types:            newTypeCache(*cacheSize),
+			probes:           probes,
+			checksums:        checksums,
+			thumbDir:         *thumbDir,
+			creds:            creds,
+
+			tlsCert:        *tlsCert,
+			tlsKey:         *tlsKey,
+			autocertDomain: *autocertDomain,
+			autocertCache:  *autocertCache,
+
+			readHeaderTimeout: *readHeaderTimeout,
+			writeTimeout:      *writeTimeout,
+			idleTimeout:       *idleTimeout,
+			shutdownTimeout:   *shutdownTimeout,
+			maxConnections:    *maxConnections,
+			keepAlive:         *keepAlive,
+			h2c:               *h2cFlag,
+
+			logFormat: *logFormat,
+
+			compressMinSize: *compressMinSize,
+
+			textPreviewMax: *textPreviewMax,
+
+			transcode: *transcode && canTranscode(),
+
+			watcher: watcher,
+
+			playerName: *playerName,
+			player:     player,
+			ie8:        *ie8,
+
+			zipMaxFiles: *zipMaxFiles,
+			zipMaxBytes: *zipMaxBytes,
+
+			throttle: newThrottle(*maxBandwidth),
+
+			corsOrigins: parseCORSOrigins(*corsOriginsSpec),
+
+			basePath:        cleanBasePath(*basePathFlag),
+			forwardedPrefix: *forwardedPrefix,
+			trustedProxies:  proxies,
+
+			open: *open,
+		}); err != nil {
+			log.Fatal("Error: ", err)
+		}
 		return
 	}
 
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDownloadRefusesPipes(t *testing.T) {
+	dir := t.TempDir()
+	if err := syscall.Mkfifo(filepath.Join(dir, "pipe.mp4"), 0644); err != nil {
+		t.Skipf("unable to create a pipe: %v", err)
+	}
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		code := make(chan int, 1)
+		go func() {
+			code <- serve(handler, method, "/_download/pipe.mp4", nil).Code
+		}()
+		select {
+		case got := <-code:
+			if got != http.StatusForbidden {
+				t.Errorf("%s of a pipe returned %d, wanted %d", method, got, http.StatusForbidden)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s of a pipe waited for a writer", method)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// testOptions returns the options main serves the mounts in specs with when
+// no other flags are given.
+func testOptions(t *testing.T, specs ...string) options {
+	t.Helper()
+	m := mounts{}
+	for _, spec := range specs {
+		if err := m.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return options{
+		mounts:           m,
+		sortBy:           "name",
+		filter:           "all",
+		workers:          4,
+		types:            newTypeCache(100),
+		maxSearchResults: 100,
+		recentLimit:      100,
+		thumbDir:         t.TempDir(),
+		textPreviewMax:   1 << 20,
+		playerName:       "videojs",
+		logFormat:        "text",
+	}
+}
+
+// writeFiles creates the files named by the keys of files, relative to dir
+// and with the values as content, and the directories they are in.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		realPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(realPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(realPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serve returns the response of handler to a method request for target with
+// header.
+func serve(handler http.Handler, method string, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestResolveSafePathRefusesOutside(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFiles(t, parent, map[string]string{
+		"root/inside.txt":  "inside",
+		"root2/secret.txt": "secret",
+	})
+	for _, urlPath := range []string{
+		"..",
+		"/..",
+		"../root2/secret.txt",
+		"/../root2/secret.txt",
+		"/a/../../root2/secret.txt",
+		"/../../../../../etc/passwd",
+	} {
+		if _, err := resolveSafePath(root, urlPath); !errors.Is(err, errOutside) {
+			t.Errorf("resolveSafePath(%q) returned %v, wanted errOutside", urlPath, err)
+		}
+	}
+	for _, urlPath := range []string{"/", "/inside.txt", "inside.txt", "/a/../inside.txt", "//inside.txt"} {
+		if got, err := resolveSafePath(root, urlPath); err != nil || got != filepath.Join(root, "inside.txt") && got != root {
+			t.Errorf("resolveSafePath(%q) returned %q, %v", urlPath, got, err)
+		}
+	}
+	opts := testOptions(t, root)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	for _, escaped := range []string{
+		"/%2e%2e/root2/secret.txt",
+		"/%2E%2E/%2e%2e/etc/passwd",
+		"/..%2froot2/secret.txt",
+	} {
+		urlPath, err := url.PathUnescape(escaped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resolveURLPath(urlPath, opts); !errors.Is(err, errOutside) {
+			t.Errorf("resolveURLPath(%q) returned %v, wanted errOutside", urlPath, err)
+		}
+		for _, target := range []string{escaped, downloadPrefix + escaped} {
+			if w := serve(handler, http.MethodGet, target, nil); w.Code != http.StatusBadRequest {
+				t.Errorf("GET %s returned %d, wanted %d", target, w.Code, http.StatusBadRequest)
+			}
+		}
+	}
+}
+
+func TestIsInside(t *testing.T) {
+	for _, tc := range []struct {
+		dir      string
+		realPath string
+		want     bool
+	}{
+		{"/root", "/root", true},
+		{"/root", "/root/", true},
+		{"/root/", "/root", true},
+		{"/root", "/root/a/b", true},
+		{"/", "/etc/passwd", true},
+		{"/root", "/root2", false},
+		{"/root", "/root2/secret", false},
+		{"/root", "/rootsecret", false},
+		{"/root", "/", false},
+		{"/root", "/etc/passwd", false},
+		{"/root/a", "/root", false},
+	} {
+		if got := isInside(filepath.FromSlash(tc.dir), filepath.FromSlash(tc.realPath)); got != tc.want {
+			t.Errorf("isInside(%q, %q) = %v, wanted %v", tc.dir, tc.realPath, got, tc.want)
+		}
+	}
+}
+
+func TestHiddenFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".secret.txt":     "secret",
+		".git/config":     "config",
+		"dir/.secret.mp4": "secret video",
+		"dir/visible.mp4": "video",
+		"visible.txt":     "visible",
+	})
+	for _, hidden := range []bool{false, true} {
+		opts := testOptions(t, dir)
+		opts.hidden = hidden
+		handler := http.HandlerFunc(handlerFunc(opts))
+		wantStatus := http.StatusNotFound
+		if hidden {
+			wantStatus = http.StatusOK
+		}
+		for _, urlPath := range []string{"/.secret.txt", "/.git/config", "/dir/.secret.mp4"} {
+			for _, target := range []string{urlPath, downloadPrefix + urlPath} {
+				if w := serve(handler, http.MethodGet, target, nil); w.Code != wantStatus {
+					t.Errorf("with hidden %v, GET %s returned %d, wanted %d", hidden, target, w.Code, wantStatus)
+				}
+			}
+		}
+		if w := serve(handler, http.MethodGet, "/.git/", nil); w.Code != wantStatus {
+			t.Errorf("with hidden %v, GET /.git/ returned %d, wanted %d", hidden, w.Code, wantStatus)
+		}
+		for _, urlPath := range []string{"/", "/dir/"} {
+			if w := serve(handler, http.MethodGet, urlPath, nil); strings.Contains(w.Body.String(), ".secret") != hidden {
+				t.Errorf("with hidden %v, the listing of %s was %s", hidden, urlPath, w.Body)
+			}
+			w := serve(handler, http.MethodGet, apiPrefix+urlPath, nil)
+			listing := page{}
+			if err := json.Unmarshal(w.Body.Bytes(), &listing); err != nil {
+				t.Fatalf("%v: %s", err, w.Body)
+			}
+			for _, entry := range listing.Entries {
+				if isHidden(entry.Name) && !hidden {
+					t.Errorf("with hidden %v, %s%s listed %q", hidden, apiPrefix, urlPath, entry.Name)
+				}
+			}
+		}
+		want := []string{"/dir/visible.mp4", "/visible.txt"}
+		if hidden {
+			want = []string{"/.git/config", "/.secret.txt", "/dir/.secret.mp4", "/dir/visible.mp4", "/visible.txt"}
+		}
+		results, _, err := search(opts, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, result := range results {
+			if !result.IsDir {
+				got = append(got, result.Path)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("with hidden %v, search found %q, wanted %q", hidden, got, want)
+		}
+		w := serve(handler, http.MethodGet, zipPrefix+"/", nil)
+		archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		got = []string{}
+		for _, f := range archive.File {
+			if !strings.HasSuffix(f.Name, "/") {
+				got = append(got, "/"+f.Name)
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("with hidden %v, the zip held %q, wanted %q", hidden, got, want)
+		}
+	}
+}
+
+func TestInstallArgsKeepIPv6HostPorts(t *testing.T) {
+	for _, hostPort := range []string{"[::]:8080", "[::1]:0"} {
+		args := installArgs("/media", hostPort, map[string]bool{})
+		if want := []string{"-dir", "/media", "-host_port", hostPort}; strings.Join(args, " ") != strings.Join(want, " ") {
+			t.Errorf("installArgs with %q returned %q, wanted %q", hostPort, args, want)
+		}
+	}
+}
+
+func TestH2C(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"notes.txt": "notes"})
+	opts := testOptions(t, dir)
+	opts.h2c = true
+	server := httptest.NewServer(newHandler(opts))
+	defer server.Close()
+	h2cClient := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	for _, tc := range []struct {
+		client     *http.Client
+		protoMajor int
+	}{
+		{h2cClient, 2},
+		{server.Client(), 1},
+	} {
+		resp, err := tc.client.Get(server.URL + downloadPrefix + "/notes.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ProtoMajor != tc.protoMajor || resp.StatusCode != 200 || string(body) != "notes" {
+			t.Errorf("got %s %d %q, wanted HTTP/%d 200 %q", resp.Proto, resp.StatusCode, body, tc.protoMajor, "notes")
+		}
+	}
+}
+
+func TestDownloadContentTypes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"movie.mp4": "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom",
+		"data.bin9": "\x01\x02\x03 no known format",
+		"notes.txt": "plain notes",
+	})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	for target, want := range map[string]string{
+		"/_download/movie.mp4": "video/mp4",
+		"/_download/data.bin9": "application/octet-stream",
+		"/_download/notes.txt": "text/plain; charset=utf-8",
+	} {
+		w := serve(handler, http.MethodGet, target, nil)
+		if got := w.Header().Get("Content-Type"); w.Code != 200 || got != want {
+			t.Errorf("GET %s returned %d with Content-Type %q, wanted %q", target, w.Code, got, want)
+		}
+	}
+}
+
+func TestLinksToOddNamesResolve(t *testing.T) {
+	dir := t.TempDir()
+	name := "My Movie (2020) #1.mp4"
+	writeFiles(t, dir, map[string]string{"sub dir/" + name: "the movie"})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	w := serve(handler, http.MethodGet, "/sub%20dir/", nil)
+	if !strings.Contains(w.Body.String(), ">"+name+"<") {
+		t.Errorf("the listing doesn't show %q: %s", name, w.Body)
+	}
+	links := regexp.MustCompile(`href="([^"]*Movie[^"]*)"`).FindAllStringSubmatch(w.Body.String(), -1)
+	downloads := 0
+	for _, link := range links {
+		target := html.UnescapeString(link[1])
+		u, err := url.Parse(target)
+		if err != nil {
+			t.Errorf("%q is not a valid link: %v", target, err)
+			continue
+		}
+		if u.Fragment != "" || strings.ContainsAny(u.EscapedPath(), " #?") {
+			t.Errorf("%q is not escaped", target)
+		}
+		if !strings.HasPrefix(u.Path, downloadPrefix+"/") {
+			if w := serve(handler, http.MethodGet, target, nil); w.Code != 200 {
+				t.Errorf("GET %s returned %d", target, w.Code)
+			}
+			continue
+		}
+		downloads++
+		if w := serve(handler, http.MethodGet, target, nil); w.Code != 200 || w.Body.String() != "the movie" {
+			t.Errorf("GET %s returned %d: %q", target, w.Code, w.Body)
+		}
+	}
+	if downloads == 0 {
+		t.Errorf("the listing has no download links to %q: %s", name, w.Body)
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{fs.ErrNotExist, http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", fs.ErrNotExist), http.StatusNotFound},
+		{errNoMount, http.StatusNotFound},
+		{fs.ErrPermission, http.StatusForbidden},
+		{errOutside, http.StatusBadRequest},
+		{errUnauthorized, http.StatusUnauthorized},
+		{errors.New("anything else"), http.StatusInternalServerError},
+	} {
+		if got := errorStatus(tc.err); got != tc.want {
+			t.Errorf("errorStatus(%v) = %d, wanted %d", tc.err, got, tc.want)
+		}
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"notes.txt":  "notes",
+		"locked.txt": "locked",
+	})
+	if err := os.Symlink(filepath.Join(dir, "notes.txt"), filepath.Join(dir, "link.txt")); err != nil {
+		t.Skipf("unable to create symlinks: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "locked.txt"), 0); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	cases := map[string]int{
+		"/missing.txt":             http.StatusNotFound,
+		"/_download/missing.txt":   http.StatusNotFound,
+		"/link.txt":                http.StatusForbidden,
+		"/_download/link.txt":      http.StatusForbidden,
+		"/%2e%2e/etc/passwd":       http.StatusBadRequest,
+		"/_download/..%2fpasswd":   http.StatusBadRequest,
+		"/?page=0":                 http.StatusBadRequest,
+		"/_download/notes.txt?x=1": http.StatusOK,
+	}
+	// Permissions don't stop root.
+	if os.Geteuid() != 0 {
+		cases["/locked.txt"] = http.StatusForbidden
+		cases["/_download/locked.txt"] = http.StatusForbidden
+	}
+	for target, want := range cases {
+		if w := serve(handler, http.MethodGet, target, nil); w.Code != want {
+			t.Errorf("GET %s returned %d, wanted %d", target, w.Code, want)
+		}
+	}
+}
+
+func TestDescriptionsFollowSymlinkPolicy(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFiles(t, parent, map[string]string{
+		"outside.md":        "outside secret",
+		"root/inside.md":    "inside description",
+		"root/sub/film.mp4": "film",
+	})
+	for link, target := range map[string]string{
+		"root/README.md":     filepath.Join(parent, "outside.md"),
+		"root/sub/README.md": filepath.Join(root, "inside.md"),
+	} {
+		if err := os.Symlink(target, filepath.Join(parent, link)); err != nil {
+			t.Skipf("unable to create symlinks: %v", err)
+		}
+	}
+	for _, followSymlinks := range []bool{false, true} {
+		opts := testOptions(t, root)
+		opts.followSymlinks = followSymlinks
+		handler := http.HandlerFunc(handlerFunc(opts))
+		w := serve(handler, http.MethodGet, "/", nil)
+		if w.Code != 200 || strings.Contains(w.Body.String(), "outside secret") {
+			t.Errorf("with followSymlinks %v, the listing of / returned %d: %s", followSymlinks, w.Code, w.Body)
+		}
+		w = serve(handler, http.MethodGet, "/sub/", nil)
+		if w.Code != 200 || strings.Contains(w.Body.String(), "inside description") != followSymlinks {
+			t.Errorf("with followSymlinks %v, the listing of /sub/ returned %d: %s", followSymlinks, w.Code, w.Body)
+		}
+	}
+}
+
+func TestEscapingSymlinksAreRefused(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	picture := &bytes.Buffer{}
+	if err := png.Encode(picture, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, parent, map[string]string{
+		"outside/secret.mp4": "outside secret",
+		"outside/secret.png": picture.String(),
+		"root/visible.txt":   "visible",
+	})
+	for link, target := range map[string]string{
+		"leak.mp4": filepath.Join(parent, "outside", "secret.mp4"),
+		"leak.png": filepath.Join(parent, "outside", "secret.png"),
+		"leakdir":  filepath.Join(parent, "outside"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("unable to create symlinks: %v", err)
+		}
+	}
+	for _, followSymlinks := range []bool{false, true} {
+		opts := testOptions(t, root)
+		opts.followSymlinks = followSymlinks
+		handler := http.HandlerFunc(handlerFunc(opts))
+		for _, target := range []string{
+			"/leak.mp4",
+			"/leakdir/",
+			"/leakdir/secret.mp4",
+			"/_download/leak.mp4",
+			"/_download/leakdir/secret.mp4",
+			"/_thumb/leak.png",
+			"/_thumb/leakdir/secret.png",
+			"/_zip/leakdir",
+		} {
+			if w := serve(handler, http.MethodGet, target, nil); w.Code != http.StatusForbidden {
+				t.Errorf("with followSymlinks %v, GET %s returned %d, wanted %d", followSymlinks, target, w.Code, http.StatusForbidden)
+			}
+		}
+		r := httptest.NewRequest(http.MethodPost, "/_zip/", strings.NewReader("file=leak.mp4&file=leakdir"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("with followSymlinks %v, zipping the symlinks returned %d, wanted %d", followSymlinks, w.Code, http.StatusForbidden)
+		}
+		w = serve(handler, http.MethodGet, zipPrefix+"/", nil)
+		archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		for _, f := range archive.File {
+			if strings.HasPrefix(f.Name, "leak") {
+				t.Errorf("with followSymlinks %v, the zip of / holds %q", followSymlinks, f.Name)
+			}
+		}
+	}
+}
+
+func TestDownloadIfRange(t *testing.T) {
+	dir := t.TempDir()
+	content := "0123456789abcdefghij"
+	writeFiles(t, dir, map[string]string{"movie.mp4": content})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	first := serve(handler, http.MethodGet, "/_download/movie.mp4", nil)
+	etag, lastModified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("got ETag %q and Last-Modified %q", etag, lastModified)
+	}
+	for _, tc := range []struct {
+		ifRange string
+		status  int
+		body    string
+	}{
+		{etag, http.StatusPartialContent, content[5:10]},
+		{lastModified, http.StatusPartialContent, content[5:10]},
+		{`"stale"`, http.StatusOK, content},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", http.StatusOK, content},
+	} {
+		w := serve(handler, http.MethodGet, "/_download/movie.mp4", http.Header{
+			"Range":    {"bytes=5-9"},
+			"If-Range": {tc.ifRange},
+		})
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("with If-Range %s, got %d %q, wanted %d %q", tc.ifRange, w.Code, w.Body, tc.status, tc.body)
+		}
+	}
+}
+
+func TestNestedLinksUseSlashes(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a/b/c/movie.mp4": "movie"})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	w := serve(handler, http.MethodGet, "/a/b/c/", nil)
+	body := w.Body.String()
+	if strings.Contains(body, `\`) {
+		t.Errorf("the listing has backslashes: %s", body)
+	}
+	for _, want := range []string{
+		`href="/a/b/c/movie.mp4"`,
+		`href="/_download/a/b/c/movie.mp4?download=1"`,
+		`href="/_zip/a/b/c"`,
+		`href="/a/b"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the listing is missing %s: %s", want, body)
+		}
+	}
+}
+
+func TestDownloadHead(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"movie.mp4": "0123456789"})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	w := serve(handler, http.MethodHead, "/_download/movie.mp4", nil)
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Errorf("got %d with %d bytes of body", w.Code, w.Body.Len())
+	}
+	for header, want := range map[string]string{
+		"Content-Type":   "video/mp4",
+		"Content-Length": "10",
+		"Accept-Ranges":  "bytes",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("got %s %q, wanted %q", header, got, want)
+		}
+	}
+	if w.Header().Get("Last-Modified") == "" {
+		t.Error("got no Last-Modified")
+	}
+}
+
+func TestDownloadMultipleRanges(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 40)
+	writeFiles(t, dir, map[string]string{"document.pdf": content})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	w := serve(handler, http.MethodGet, "/_download/document.pdf", http.Header{
+		"Range": {"bytes=0-99,200-299"},
+	})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("got %d", w.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got Content-Type %q: %v", w.Header().Get("Content-Type"), err)
+	}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 0-99/400", content[0:100]},
+		{"bytes 200-299/400", content[200:300]},
+	} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := part.Header.Get("Content-Range"); got != want.contentRange || string(body) != want.body {
+			t.Errorf("got part %q with %q, wanted %q with %q", got, body, want.contentRange, want.body)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("got more than two parts: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errNoMount = errors.New("no such mount")
+)
+
+type mount struct {
+	name string
+	dir  string
+}
+
+// mounts are the directories being served. A single unnamed mount is served
+// at the root, while named mounts are served as top level directories named
+// after the mounts.
+type mounts []mount
+
+// String returns the mounts in the same format Set accepts.
+func (m *mounts) String() string {
+	if m == nil {
+		return ""
+	}
+	specs := []string{}
+	for _, mount := range *m {
+		if mount.name == "" {
+			specs = append(specs, mount.dir)
+		} else {
+			specs = append(specs, fmt.Sprintf("%s=%s", mount.name, mount.dir))
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+// Set adds the comma separated path or name=path pairs in value to the mounts.
+// Mounts without names are named after the base name of their path if more
+// than one mount is given.
+func (m *mounts) Set(value string) error {
+	for _, spec := range strings.Split(value, ",") {
+		if spec == "" {
+			continue
+		}
+		mount := mount{dir: spec}
+		// Names can't contain path separators or drive letters, so paths
+		// like C:\a=b are not mistaken for named mounts.
+		if parts := strings.SplitN(spec, "=", 2); len(parts) == 2 && !strings.ContainsAny(parts[0], `/\:`) {
+			mount.name, mount.dir = parts[0], parts[1]
+			if mount.name == "" {
+				return fmt.Errorf("invalid mount name in %q", spec)
+			}
+		}
+		dir, err := filepath.Abs(mount.dir)
+		if err != nil {
+			return err
+		}
+		mount.dir = dir
+		*m = append(*m, mount)
+	}
+	if len(*m) > 1 {
+		seen := map[string]bool{}
+		for i := range *m {
+			if (*m)[i].name == "" {
+				(*m)[i].name = filepath.Base((*m)[i].dir)
+			}
+			if seen[(*m)[i].name] {
+				return fmt.Errorf("more than one mount named %q", (*m)[i].name)
+			}
+			seen[(*m)[i].name] = true
+		}
+	}
+	return nil
+}
+
+// check returns an error describing the first mount that isn't a readable
+// directory, so that a mistyped -dir is reported at startup instead of on
+// every request. A single unnamed mount may also be a readable file.
+func (m mounts) check() error {
+	for _, mount := range m {
+		info, err := os.Stat(mount.dir)
+		if err != nil {
+			return fmt.Errorf("unable to serve %q: %w", mount.dir, err)
+		}
+		if !info.IsDir() {
+			if len(m) > 1 || mount.name != "" || !info.Mode().IsRegular() {
+				return fmt.Errorf("unable to serve %q: not a directory", mount.dir)
+			}
+			f, err := os.Open(mount.dir)
+			if err != nil {
+				return fmt.Errorf("unable to serve %q: %w", mount.dir, err)
+			}
+			f.Close()
+			continue
+		}
+		dir, err := os.Open(mount.dir)
+		if err != nil {
+			return fmt.Errorf("unable to serve %q: %w", mount.dir, err)
+		}
+		_, err = dir.Readdirnames(1)
+		dir.Close()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("unable to serve %q: %w", mount.dir, err)
+		}
+	}
+	return nil
+}
+
+// singleFile returns mounts serving the directory of the file given as the
+// only mount, and the name of the file. If the mounts aren't a single file,
+// they are returned as they are with an empty name.
+func (m mounts) singleFile() (mounts, string) {
+	if len(m) != 1 || m[0].name != "" {
+		return m, ""
+	}
+	if info, err := os.Stat(m[0].dir); err != nil || info.IsDir() {
+		return m, ""
+	}
+	return mounts{{dir: filepath.Dir(m[0].dir)}}, filepath.Base(m[0].dir)
+}
+
+// isVirtualRoot returns whether urlPath is the root listing of named mounts.
+func (m mounts) isVirtualRoot(urlPath string) bool {
+	return (len(m) > 1 || m[0].name != "") && path.Clean("/"+urlPath) == "/"
+}
+
+// root returns the directory of the mount urlPath belongs to, and the rest of
+// urlPath relative to that directory. Paths climbing above the root are
+// refused with errOutside.
+func (m mounts) root(urlPath string) (string, string, error) {
+	if rel := path.Clean(strings.TrimPrefix(urlPath, "/")); rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", "", fmt.Errorf("%w: %q", errOutside, urlPath)
+	}
+	urlPath = path.Clean("/" + urlPath)
+	if len(m) == 1 && m[0].name == "" {
+		return m[0].dir, urlPath, nil
+	}
+	segments := strings.SplitN(strings.TrimPrefix(urlPath, "/"), "/", 2)
+	for _, mount := range m {
+		if mount.name == segments[0] {
+			rest := "/"
+			if len(segments) > 1 {
+				rest += segments[1]
+			}
+			return mount.dir, rest, nil
+		}
+	}
+	return "", "", fmt.Errorf("%w: %q", errNoMount, segments[0])
+}
+
+// entries returns the mounts the user of opts may see as directory entries
+// for the root listing.
+func (m mounts) entries(opts options) []dirEntry {
+	entries := []dirEntry{}
+	for _, mount := range m {
+		if checkAccess(mount.dir, mount.dir, opts) != nil {
+			continue
+		}
+		entry := dirEntry{
+			BuildLink: true,
+			IsDir:     true,
+			Name:      mount.name,
+			Type:      "directory",
+		}
+		if info, err := os.Stat(mount.dir); err == nil {
+			entry.ModTime = info.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+	sortEntries(entries, opts.sortBy, opts.sortDescending)
+	return entries
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadsFromOverlappingMounts(t *testing.T) {
+	parent := t.TempDir()
+	writeFiles(t, parent, map[string]string{
+		"first/x":          "first x",
+		"second/x":         "second x",
+		"first/sub/y.txt":  "first y",
+		"second/sub/y.txt": "second y",
+	})
+	opts := testOptions(t, "a="+filepath.Join(parent, "first"), "b="+filepath.Join(parent, "second"))
+	handler := http.HandlerFunc(handlerFunc(opts))
+	for target, want := range map[string]string{
+		"/_download/a/x":         "first x",
+		"/_download/b/x":         "second x",
+		"/_download/a/sub/y.txt": "first y",
+		"/_download/b/sub/y.txt": "second y",
+	} {
+		w := serve(handler, http.MethodGet, target, nil)
+		if w.Code != 200 {
+			t.Errorf("GET %s returned %d: %s", target, w.Code, w.Body)
+		} else if got := w.Body.String(); got != want {
+			t.Errorf("GET %s returned %q, wanted %q", target, got, want)
+		}
+	}
+	if w := serve(handler, http.MethodGet, "/_download/x", nil); w.Code != 404 {
+		t.Errorf("GET /_download/x outside the mounts returned %d, wanted 404", w.Code)
+	}
+}
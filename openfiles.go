@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	// openFiles limits how many files requests read at once, so that busy
+	// servers listing huge directories don't run out of file descriptors. It
+	// is sized with -max_open_files.
+	openFiles fileLimiter
+	// heldFiles limits the files and directories requests keep open while
+	// they open others, like listed directories, or while they are sent to
+	// clients, like downloads. Downloads can take hours, so they get their
+	// own pool rather than starve openFiles, and since nothing waits for
+	// heldFiles while holding an openFiles slot, the pools can't deadlock. It
+	// is sized with -max_held_files.
+	heldFiles fileLimiter
+)
+
+// fileLimiter is a semaphore of open files. A nil fileLimiter has no limit.
+type fileLimiter chan struct{}
+
+func newFileLimiter(size int) fileLimiter {
+	if size < 1 {
+		return nil
+	}
+	return make(fileLimiter, size)
+}
+
+// acquire waits until another file may be opened.
+func (l fileLimiter) acquire() {
+	if l != nil {
+		l <- struct{}{}
+	}
+}
+
+// release makes room for another file.
+func (l fileLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// open opens the file at path for reading like os.Open, once l has room for
+// it.
+func (l fileLimiter) open(path string) (*limitedFile, error) {
+	l.acquire()
+	f, err := os.Open(path)
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &limitedFile{File: f, limiter: l}, nil
+}
+
+// limitedFile is a file counted by a fileLimiter until it is closed.
+type limitedFile struct {
+	*os.File
+	limiter fileLimiter
+	once    sync.Once
+}
+
+// Close closes the file and makes room for another. Closing it more than
+// once only makes room once.
+func (f *limitedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.limiter.release)
+	return err
+}
+
+// openFile opens the file at path for reading like os.Open, once openFiles
+// has room for it. Only files that are read without opening other files
+// while open may be opened with it, since waiting for room while holding a
+// slot could wait forever. The rest are opened with openHeldFile.
+func openFile(path string) (*limitedFile, error) {
+	return openFiles.open(path)
+}
+
+// openHeldFile opens the file or directory at path for reading like os.Open,
+// once heldFiles has room for it. Files may be opened with openFile while it
+// is open, but not with openHeldFile.
+func openHeldFile(path string) (*limitedFile, error) {
+	return heldFiles.open(path)
+}
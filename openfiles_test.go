@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFDs returns how many file descriptors the process has open, and skips
+// the test where that can't be counted.
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("unable to count open files: %v", err)
+	}
+	return len(entries)
+}
+
+// limitOpenFiles sets openFiles and heldFiles to size slots each until the
+// test ends.
+func limitOpenFiles(t *testing.T, size int) {
+	oldOpen, oldHeld := openFiles, heldFiles
+	openFiles, heldFiles = newFileLimiter(size), newFileLimiter(size)
+	t.Cleanup(func() {
+		openFiles, heldFiles = oldOpen, oldHeld
+	})
+}
+
+// checkNoLeaks fails the test if more than fds files are open, or if any
+// limiter slot is still taken.
+func checkNoLeaks(t *testing.T, fds int, what string) {
+	t.Helper()
+	if got := openFDs(t); got > fds {
+		t.Errorf("%s leaked %d open files", what, got-fds)
+	}
+	if len(openFiles) != 0 || len(heldFiles) != 0 {
+		t.Errorf("%s left %d openFiles and %d heldFiles slots taken", what, len(openFiles), len(heldFiles))
+	}
+}
+
+func TestHammerLeaksNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"README.md":     "# Media",
+		"sub/notes.txt": "notes",
+		"sub/v.srt":     "1\n00:00:01,000 --> 00:00:02,000\nHi\n",
+	}
+	for i := 0; i < 50; i++ {
+		files[fmt.Sprintf("video%02d.mp4", i)] = "not really a video"
+		files[fmt.Sprintf("sub/v%02d.txt", i)] = "text"
+	}
+	writeFiles(t, dir, files)
+	opts := testOptions(t, dir)
+	opts.webdav = true
+	// Few slots make requests wait for each other, which is where leaks and
+	// deadlocks show.
+	limitOpenFiles(t, 2)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	targets := []string{
+		"/",
+		"/?view=grid",
+		"/?sort=date&order=desc",
+		"/sub/",
+		"/sub/notes.txt",
+		"/video07.mp4",
+		"/_api/",
+		"/_api/sub",
+		"/_download/video01.mp4",
+		"/_download/sub/notes.txt",
+		"/_subtitle/sub/v.srt",
+		"/_zip/sub",
+		"/_search?q=video",
+		"/_recent",
+		"/_dav/sub/notes.txt",
+		"/missing",
+	}
+	hammer := func() {
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			for _, target := range targets {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					serve(handler, http.MethodGet, target, nil)
+				}()
+			}
+		}
+		wg.Wait()
+	}
+	// The first round fills caches and starts runtime helpers, which open
+	// files of their own.
+	hammer()
+	fds := openFDs(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			hammer()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatal("requests waited for open files forever")
+	}
+	checkNoLeaks(t, fds, "hammering the server")
+}
+
+func TestErrorsLeakNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"notes.txt":     "notes",
+		"broken.jpg":    "not really an image",
+		"sub/video.mp4": "not really a video",
+	})
+	opts := testOptions(t, dir)
+	opts.webdav = true
+	limitOpenFiles(t, 2)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	for _, tc := range []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/missing", 404},
+		{http.MethodGet, "/sub/?page=abc", 400},
+		{http.MethodGet, "/sub/?sort=bogus", 400},
+		{http.MethodGet, "/_api/sub?page=abc", 400},
+		{http.MethodGet, "/_api/sub?sort=bogus", 400},
+		{http.MethodGet, "/_api/missing", 404},
+		{http.MethodGet, "/_download/sub", 400},
+		{http.MethodGet, "/_download/missing", 404},
+		{http.MethodGet, "/_dav/sub", 405},
+		{http.MethodGet, "/_dav/missing", 404},
+		{http.MethodGet, "/_thumb/notes.txt", 400},
+		{http.MethodGet, "/_thumb/broken.jpg", 500},
+		{http.MethodGet, "/_thumb/sub/video.mp4?w=abc", 400},
+		{http.MethodGet, "/_thumb/missing", 404},
+	} {
+		// Runtime helpers open files of their own the first time around.
+		serve(handler, tc.method, tc.target, nil)
+		fds := openFDs(t)
+		for i := 0; i < 20; i++ {
+			if w := serve(handler, tc.method, tc.target, nil); w.Code != tc.status {
+				t.Fatalf("%s %s returned %d, wanted %d: %s", tc.method, tc.target, w.Code, tc.status, w.Body)
+			}
+		}
+		checkNoLeaks(t, fds, tc.method+" "+tc.target)
+	}
+}
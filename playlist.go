@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// writePlaylist writes the video and audio files among entries, served at
+// urlPath, as an extended M3U playlist. Entries without a probed duration get
+// -1, meaning unknown. The download URLs are absolute, so that the playlist
+// also works when saved and opened by another program.
+func writePlaylist(w http.ResponseWriter, r *http.Request, urlPath string, entries []dirEntry) error {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	buf := bufio.NewWriter(w)
+	fmt.Fprintln(buf, "#EXTM3U")
+	for _, entry := range entries {
+		if entry.mimeType != "video" && entry.mimeType != "audio" {
+			continue
+		}
+		seconds := -1
+		if entry.Duration > 0 {
+			seconds = int(entry.Duration)
+		}
+		title := strings.TrimSuffix(entry.Name, path.Ext(entry.Name))
+		fmt.Fprintf(buf, "#EXTINF:%d,%s\n", seconds, strings.ReplaceAll(title, "\n", " "))
+		fmt.Fprintf(buf, "%s://%s%s\n", scheme, r.Host, href(basePath(r), downloadPrefix, urlPath, entry.Name))
+	}
+	return buf.Flush()
+}
+
+func handlePlaylist(w http.ResponseWriter, r *http.Request, dir *os.File, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "playlist")
+	entries, err := readEntries(dir.Name(), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	urlPath := path.Join("/", r.URL.Path)
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	name := path.Base(urlPath)
+	if name == "/" {
+		name = "mediaweb"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+		"filename": name + ".m3u",
+	}))
+	// Probing the durations is slow, and pointless without a body.
+	if r.Method == http.MethodHead {
+		return
+	}
+	opts.probes.probeAll(dir.Name(), entries, opts.workers)
+	if err := writePlaylist(w, r, urlPath, entries); err != nil {
+		logger(r).errorf("Unable to write playlist of %q: %v", dir.Name(), err)
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlaylistDurationsAreProbed(t *testing.T) {
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	script := "#!/bin/sh\necho >> " + calls + "\necho '{\"format\":{\"duration\":\"12.5\"}}'\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffprobe"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.mp3":     "not really a song",
+		"b.mp4":     "not really a video",
+		"notes.txt": "notes",
+	})
+	ffprobeRuns := func() int {
+		content, err := os.ReadFile(calls)
+		if os.IsNotExist(err) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(content), "\n")
+	}
+	for _, tc := range []struct {
+		probes *probeCache
+		extinf string
+		runs   int
+	}{
+		{nil, "#EXTINF:-1,", 0},
+		{newProbeCache(10), "#EXTINF:12,", 2},
+	} {
+		os.Remove(calls)
+		opts := testOptions(t, dir)
+		opts.probes = tc.probes
+		handler := http.HandlerFunc(handlerFunc(opts))
+		// The second playlist is probed from the cache.
+		for i := 0; i < 2; i++ {
+			w := serve(handler, http.MethodGet, "/?format=m3u", nil)
+			if got := strings.Count(w.Body.String(), tc.extinf); got != 2 {
+				t.Errorf("got %d entries with %q: %s", got, tc.extinf, w.Body)
+			}
+		}
+		if got := ffprobeRuns(); got != tc.runs {
+			t.Errorf("ffprobe ran %d times, wanted %d", got, tc.runs)
+		}
+	}
+}
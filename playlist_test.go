@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlaylistLinksToHost(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"sub/My Song.mp3": "not really a song"})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	for _, host := range []string{"[::1]:8080", "[::]:8080", "localhost:8080"} {
+		r := httptest.NewRequest(http.MethodGet, "/sub/?format=m3u", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if want := "http://" + host + "/_download/sub/My%20Song.mp3\n"; !strings.Contains(w.Body.String(), want) {
+			t.Errorf("the playlist for %s is missing %q: %s", host, want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mediaInfo is what ffprobe tells about a video or audio file.
+type mediaInfo struct {
+	duration   float64
+	resolution string
+	// videoCodec and audioCodec are the ffmpeg names of the codecs of the
+	// first video and audio streams, like h264 and aac.
+	videoCodec string
+	audioCodec string
+}
+
+type probeCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	info    mediaInfo
+}
+
+// probeCache remembers what ffprobe found out about media files, since running
+// it takes much longer than reading a file header. Like typeCache, entries are
+// invalidated when the size or modification time of the file changes, and
+// the least recently used entries are evicted when the cache is full.
+type probeCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// newProbeCache returns a cache of size entries, or nil if ffprobe isn't
+// installed.
+func newProbeCache(size int) *probeCache {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		infof("ffprobe not found, durations and resolutions are not shown: %v", err)
+		return nil
+	}
+	return &probeCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// probeMedia runs ffprobe to find the duration of the video or audio file at
+// realPath, and the resolution and codecs of its first streams.
+func probeMedia(realPath string) (mediaInfo, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration:stream=codec_type,codec_name,width,height", "-of", "json", realPath).Output()
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	probed := struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}{}
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return mediaInfo{}, err
+	}
+	result := mediaInfo{}
+	// Still images and some streams have no duration.
+	if duration, err := strconv.ParseFloat(probed.Format.Duration, 64); err == nil {
+		result.duration = duration
+	}
+	for _, stream := range probed.Streams {
+		switch stream.CodecType {
+		case "video":
+			if result.videoCodec == "" {
+				result.videoCodec = stream.CodecName
+				if stream.Width > 0 && stream.Height > 0 {
+					result.resolution = fmt.Sprintf("%dx%d", stream.Width, stream.Height)
+				}
+			}
+		case "audio":
+			if result.audioCodec == "" {
+				result.audioCodec = stream.CodecName
+			}
+		}
+	}
+	return result, nil
+}
+
+// probe returns what ffprobe finds out about the file at path, described by
+// entry.
+func (c *probeCache) probe(path string, entry dirEntry) (mediaInfo, error) {
+	if c.size < 1 {
+		return probeMedia(path)
+	}
+	c.lock.Lock()
+	if elem, found := c.entries[path]; found {
+		cached := elem.Value.(*probeCacheEntry)
+		if cached.size == entry.Size && cached.modTime.Equal(entry.ModTime) {
+			c.order.MoveToFront(elem)
+			c.lock.Unlock()
+			return cached.info, nil
+		}
+		c.order.Remove(elem)
+		delete(c.entries, path)
+	}
+	c.lock.Unlock()
+
+	// Failures are remembered too, so that broken files aren't probed again
+	// on every listing.
+	info, err := probeMedia(path)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, found := c.entries[path]; found {
+		c.order.Remove(elem)
+	}
+	c.entries[path] = c.order.PushFront(&probeCacheEntry{
+		path:    path,
+		size:    entry.Size,
+		modTime: entry.ModTime,
+		info:    info,
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*probeCacheEntry).path)
+	}
+	return info, err
+}
+
+// probeAll fills in the durations and resolutions of the video and audio
+// files among entries, which were read from dir. Files ffprobe fails on are
+// left without them. At most workers probes run at once. A nil cache probes
+// nothing, so that listings work without ffprobe.
+func (c *probeCache) probeAll(dir string, entries []dirEntry, workers int) {
+	for _, done := range c.probeEach(dir, entries, workers) {
+		<-done
+	}
+}
+
+// probeEach probes entries like probeAll, but in the background. It returns
+// a channel per entry, closed when the entry is probed, so that entries can
+// be shown as soon as they are ready.
+func (c *probeCache) probeEach(dir string, entries []dirEntry, workers int) []chan struct{} {
+	done := make([]chan struct{}, len(entries))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	if c == nil {
+		for _, ch := range done {
+			close(ch)
+		}
+		return done
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	indices := make(chan int)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for index := range indices {
+				path := filepath.Join(dir, entries[index].Name)
+				if info, err := c.probe(path, entries[index]); err != nil {
+					debugf("Unable to probe %q: %v", path, err)
+				} else {
+					entries[index].Duration = info.duration
+					entries[index].Resolution = info.resolution
+				}
+				close(done[index])
+			}
+		}()
+	}
+	go func() {
+		// Only the fields read here are never written by the workers.
+		for index := range entries {
+			if entries[index].mimeType == "video" || entries[index].mimeType == "audio" {
+				indices <- index
+			} else {
+				close(done[index])
+			}
+		}
+		close(indices)
+	}()
+	return done
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of reverse proxies whose X-Forwarded-For
+// and X-Real-IP headers are believed.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies returns the networks in the comma separated list spec
+// of CIDRs, like 10.0.0.0/8. Single addresses are accepted too.
+func parseTrustedProxies(spec string) (trustedProxies, error) {
+	result := trustedProxies{}
+	for _, cidr := range strings.Split(spec, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", cidr, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// contains returns whether addr, an IP address with or without port, is one
+// of the trusted proxies.
+func (t trustedProxies) contains(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client that made r, according to the
+// trusted proxies it passed through. X-Forwarded-For is read from the right,
+// since each proxy appends the address it got the request from, and the
+// first address not belonging to a trusted proxy is the client. Anything
+// further left was sent by the client, and could be made up.
+func (t trustedProxies) clientAddr(r *http.Request) string {
+	if !t.contains(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if i == 0 || !t.contains(hop) {
+				return hop
+			}
+		}
+		return r.RemoteAddr
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return r.RemoteAddr
+}
+
+// trustProxies wraps handler to replace the remote address of requests from
+// the trusted proxies with the client address they forwarded, so that it is
+// what gets logged. The headers of all other requests are ignored, since any
+// client can send them.
+func trustProxies(proxies trustedProxies, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client := proxies.clientAddr(r); client != r.RemoteAddr {
+			r = r.Clone(r.Context())
+			r.RemoteAddr = client
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+const (
+	recentPrefix = "/_recent"
+)
+
+var (
+	recentTemplate = template.Must(loadTemplate("", "recent.html"))
+)
+
+type recentFile struct {
+	Path    string    `json:"path"`
+	Link    string    `json:"-"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// recent walks all mounts and returns the at most limit most recently modified
+// files passing the -filter, newest first. Directories that can't be read are
+// skipped.
+func recent(opts options, limit int) ([]recentFile, error) {
+	type candidate struct {
+		realPath string
+		urlPath  string
+		info     fs.FileInfo
+	}
+	candidates := []candidate{}
+	for _, mount := range opts.mounts {
+		urlRoot := path.Join("/", mount.name)
+		if err := filepath.WalkDir(mount.dir, func(realPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if realPath == mount.dir {
+				if checkAccess(mount.dir, mount.dir, opts) != nil {
+					return filepath.SkipDir
+				}
+			} else if !isListed(d.Name(), opts.hidden) || !isAllowed(d.Name(), d.IsDir(), opts.allowExt) || (d.IsDir() && !mayEnter(realPath, opts)) {
+				return skipEntry(d)
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(mount.dir, realPath)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, candidate{
+				realPath: realPath,
+				urlPath:  path.Join(urlRoot, filepath.ToSlash(rel)),
+				info:     info,
+			})
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].info.ModTime().After(candidates[j].info.ModTime())
+	})
+	results := []recentFile{}
+	for _, c := range candidates {
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+		// Only the newest files are detected, since detecting all of them
+		// would read the header of every file in the library.
+		if opts.filter != "all" {
+			fileType, err := opts.types.match(c.realPath, c.info)
+			if err != nil || !filters[opts.filter](fileType.MIME.Type) {
+				continue
+			}
+		}
+		results = append(results, recentFile{
+			Path:    c.urlPath,
+			Link:    (&url.URL{Path: c.urlPath}).EscapedPath(),
+			Size:    c.info.Size(),
+			ModTime: c.info.ModTime(),
+		})
+	}
+	return results, nil
+}
+
+func handleRecent(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "recent")
+	limit := opts.recentLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 1 {
+			httpError(w, r, "invalid limit "+strconv.Quote(limitParam), 400)
+			return
+		}
+	}
+	results, err := recent(opts, limit)
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"results": results,
+		}); err != nil {
+			httpError(w, r, err.Error(), 500)
+		}
+		return
+	}
+	if err := recentTemplate.Execute(w, pageData(r, map[string]interface{}{
+		"results":      results,
+		"searchPrefix": searchPrefix,
+	})); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"gopkg.in/h2non/filetype.v1/types"
+)
+
+// fileRenderer writes the page showing the file f, detected to be fileType.
+type fileRenderer func(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options)
+
+// mimeRenderer renders the files whose MIME types start with prefix.
+type mimeRenderer struct {
+	prefix string
+	render fileRenderer
+}
+
+var (
+	// renderers are tried in order, so more specific prefixes go first.
+	// Showing a new kind of file only needs an entry here.
+	renderers = []mimeRenderer{
+		{prefix: hlsPlaylistType, render: renderVideo},
+		{prefix: "video/", render: renderVideo},
+		{prefix: "audio/", render: renderAudio},
+		{prefix: "image/", render: renderImage},
+		{prefix: "text/", render: renderText},
+		{prefix: "application/x-subrip", render: renderText},
+		{prefix: "application/pdf", render: renderPDF},
+	}
+	// defaultRenderer renders the files none of the renderers match.
+	defaultRenderer fileRenderer = renderDownload
+)
+
+// findRenderer returns the renderer of files of fileType.
+func findRenderer(fileType types.Type) fileRenderer {
+	for _, renderer := range renderers {
+		if strings.HasPrefix(fileType.MIME.Value, renderer.prefix) {
+			return renderer.render
+		}
+	}
+	return defaultRenderer
+}
+
+// renderPage executes tmpl for the file f with the data all file pages get,
+// overridden by data.
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, fileType types.Type, opts options, data map[string]interface{}) {
+	page := map[string]interface{}{
+		"downloadPrefix": downloadPrefix,
+		"name":           path.Join("/", r.URL.Path),
+		"type":           fileType.MIME.Value,
+		"transcode":      false,
+		"ie8":            opts.ie8,
+		"hls":            isHLS(fileType),
+		"poster":         "",
+		"text":           "",
+		"subtitles":      []subtitle(nil),
+		"player":         opts.player.below(basePath(r)),
+		"prev":           "",
+		"next":           "",
+	}
+	for key, value := range data {
+		page[key] = value
+	}
+	if err := tmpl.Execute(w, pageData(r, page)); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
+
+func renderDownload(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options) {
+	renderPage(w, r, downloadTemplate, fileType, opts, nil)
+}
+
+func renderAudio(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options) {
+	prev, next := siblings(r, fileType, opts)
+	renderPage(w, r, audioTemplate, fileType, opts, map[string]interface{}{
+		"prev": prev,
+		"next": next,
+	})
+}
+
+func renderImage(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options) {
+	renderPage(w, r, imageTemplate, fileType, opts, nil)
+}
+
+func renderPDF(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options) {
+	renderPage(w, r, pdfTemplate, fileType, opts, nil)
+}
+
+// siblings returns links to the files of the same kind as the one r asks
+// for, detected to be fileType, before and after it in its directory. They
+// are in the order of the listing, so that a series can be played through.
+// The links are empty if there are no such files.
+func siblings(r *http.Request, fileType types.Type, opts options) (string, string) {
+	if opts.singleFile != "" {
+		return "", ""
+	}
+	opts, err := sortOptions(r, opts)
+	if err != nil {
+		return "", ""
+	}
+	urlDir, name := path.Split(path.Join("/", r.URL.Path))
+	realDir, err := resolveURLPath(urlDir, opts)
+	if err != nil {
+		logger(r).errorf("Unable to find the directory of %q: %v", r.URL.Path, err)
+		return "", ""
+	}
+	entries, err := readEntries(realDir, opts)
+	if err != nil {
+		logger(r).errorf("Unable to list %q: %v", realDir, err)
+		return "", ""
+	}
+	prev, next := "", ""
+	found := false
+	for _, entry := range entries {
+		if entry.IsDir || entry.mimeType != fileType.MIME.Type {
+			continue
+		}
+		if entry.Name == name {
+			found = true
+		} else if !found {
+			prev = entry.Name
+		} else {
+			next = entry.Name
+			break
+		}
+	}
+	link := func(sibling string) string {
+		if !found || sibling == "" {
+			return ""
+		}
+		return href(basePath(r), urlDir, sibling) + sortQuery(r)
+	}
+	return link(prev), link(next)
+}
+
+// renderVideo shows videos and HLS playlists in the player. Segments of
+// playlists are fetched relative to the playlist, so they are served from
+// the download prefix too.
+func renderVideo(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options) {
+	if isHLS(fileType) {
+		renderPage(w, r, *players[opts.playerName].template, fileType, opts, nil)
+		return
+	}
+	data := map[string]interface{}{}
+	data["prev"], data["next"] = siblings(r, fileType, opts)
+	if canExtractFrames() {
+		data["poster"] = href(basePath(r), thumbPrefix, r.URL.Path)
+	}
+	subtitles, err := findSubtitles(f.Name(), path.Join("/", r.URL.Path), opts.allowExt)
+	if err != nil {
+		logger(r).errorf("Unable to look for subtitles for %q: %v", f.Name(), err)
+	}
+	data["subtitles"] = subtitles
+	if opts.transcode {
+		if r.URL.Query().Get("transcode") != "" {
+			// The player loads the video from where it is transcoded.
+			data["downloadPrefix"] = transcodePrefix
+			data["type"] = "video/mp4"
+		} else if info, err := probeMedia(f.Name()); err == nil {
+			data["transcode"] = needsTranscoding(fileType.MIME.Value, info)
+		}
+	}
+	renderPage(w, r, *players[opts.playerName].template, fileType, opts, data)
+}
+
+// renderText puts text files in the page. Larger files only get the download
+// link, since the whole file is put in the page.
+func renderText(w http.ResponseWriter, r *http.Request, f *os.File, fileType types.Type, opts options) {
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	if info.Size() > opts.textPreviewMax {
+		renderDownload(w, r, f, fileType, opts)
+		return
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	if content, err = toUTF8(content); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	renderPage(w, r, textTemplate, fileType, opts, map[string]interface{}{
+		"text": string(content),
+	})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVideoPagesHaveTitles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"My Movie.mp4": "not really a video"})
+	for name := range players {
+		opts := testOptions(t, dir)
+		opts.playerName = name
+		w := serve(http.HandlerFunc(handlerFunc(opts)), http.MethodGet, "/My%20Movie.mp4", nil)
+		if want := "<title>/My Movie.mp4 - " + siteTitle + "</title>"; !strings.Contains(w.Body.String(), want) {
+			t.Errorf("the %s player page is missing %q: %s", name, want, w.Body)
+		}
+	}
+}
+
+func TestAudioPage(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"song.mp3": "ID3 not really a song"})
+	w := serve(http.HandlerFunc(handlerFunc(testOptions(t, dir))), http.MethodGet, "/song.mp3", nil)
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	for _, want := range []string{
+		"<audio controls",
+		`<source src="/_download/song.mp3" type='audio/mpeg'>`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("the page is missing %q: %s", want, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "<video") {
+		t.Errorf("the page has a video player: %s", w.Body)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength limits the IDs accepted from clients, which end up
+	// in every log line of their requests.
+	maxRequestIDLength = 128
+)
+
+// requestIDKey is the request context key of the request ID.
+type requestIDKey struct{}
+
+// requestID returns the ID of r, or "" if it has none.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID returns whether id, sent by a client, is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// assignRequestIDs wraps handler to give every request an ID, which is sent
+// back in the X-Request-ID header and included in the log lines about the
+// request. IDs sent by clients or proxies in the same header are kept, so
+// that their logs can be correlated with ours.
+func assignRequestIDs(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestLogger logs about a request, prefixing the lines with its ID.
+type requestLogger string
+
+// logger returns the logger for r.
+func logger(r *http.Request) requestLogger {
+	return requestLogger(requestID(r))
+}
+
+func (l requestLogger) logAt(level logLevel, format string, args ...interface{}) {
+	if l != "" {
+		format = "[" + string(l) + "] " + format
+	}
+	logAt(level, format, args...)
+}
+
+func (l requestLogger) errorf(format string, args ...interface{}) {
+	l.logAt(levelError, format, args...)
+}
+
+func (l requestLogger) infof(format string, args ...interface{}) {
+	l.logAt(levelInfo, format, args...)
+}
+
+func (l requestLogger) debugf(format string, args ...interface{}) {
+	l.logAt(levelDebug, format, args...)
+}
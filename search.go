@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	searchPrefix = "/_search"
+)
+
+var (
+	searchTemplate = template.Must(loadTemplate("", "search.html"))
+
+	errEnoughResults = errors.New("enough results")
+)
+
+type searchResult struct {
+	Path  string `json:"path"`
+	Link  string `json:"-"`
+	IsDir bool   `json:"isDir"`
+}
+
+// search walks all mounts for files and directories whose names contain
+// query, ignoring case. It returns at most maxResults matches, and whether
+// there might have been more. Directories that can't be read are skipped.
+func search(opts options, query string, maxResults int) ([]searchResult, bool, error) {
+	query = strings.ToLower(query)
+	results := []searchResult{}
+	for _, mount := range opts.mounts {
+		urlRoot := path.Join("/", mount.name)
+		if err := filepath.WalkDir(mount.dir, func(realPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if realPath == mount.dir {
+				if checkAccess(mount.dir, mount.dir, opts) != nil {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !isListed(d.Name(), opts.hidden) || !isAllowed(d.Name(), d.IsDir(), opts.allowExt) || (d.IsDir() && !mayEnter(realPath, opts)) {
+				return skipEntry(d)
+			}
+			// Symlinks are only found if they could be followed, and other
+			// special files never.
+			if !d.IsDir() && !d.Type().IsRegular() && (!opts.followSymlinks || checkSymlinks(mount.dir, realPath, true) != nil) {
+				return nil
+			}
+			if !strings.Contains(strings.ToLower(d.Name()), query) {
+				return nil
+			}
+			rel, err := filepath.Rel(mount.dir, realPath)
+			if err != nil {
+				return err
+			}
+			urlPath := path.Join(urlRoot, filepath.ToSlash(rel))
+			results = append(results, searchResult{
+				Path:  urlPath,
+				Link:  (&url.URL{Path: urlPath}).EscapedPath(),
+				IsDir: d.IsDir(),
+			})
+			if maxResults > 0 && len(results) >= maxResults {
+				return errEnoughResults
+			}
+			return nil
+		}); err == errEnoughResults {
+			return results, true, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	return results, false, nil
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "search")
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		httpError(w, r, "missing q parameter", 400)
+		return
+	}
+	results, truncated, err := search(opts, query, opts.maxSearchResults)
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"results":   results,
+			"truncated": truncated,
+		}); err != nil {
+			httpError(w, r, err.Error(), 500)
+		}
+		return
+	}
+	if err := searchTemplate.Execute(w, pageData(r, map[string]interface{}{
+		"query":        query,
+		"results":      results,
+		"truncated":    truncated,
+		"searchPrefix": searchPrefix,
+	})); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSearchSkipsEscapingSymlinks(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	writeFiles(t, parent, map[string]string{
+		"root/video.mp4":   "video",
+		"outside/film.mp4": "secret",
+	})
+	for link, target := range map[string]string{
+		"escaping.mp4": filepath.Join(parent, "outside", "film.mp4"),
+		"linked.mp4":   filepath.Join(root, "video.mp4"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("unable to create symlinks: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		followSymlinks bool
+		want           []string
+	}{
+		{false, []string{"/video.mp4"}},
+		{true, []string{"/linked.mp4", "/video.mp4"}},
+	} {
+		opts := testOptions(t, root)
+		opts.followSymlinks = tc.followSymlinks
+		results, _, err := search(opts, ".mp4", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, result := range results {
+			got = append(got, result.Path)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("with followSymlinks %v, found %q, wanted %q", tc.followSymlinks, got, tc.want)
+		}
+	}
+}
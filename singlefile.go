@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// singleFilePath returns the path in the directory of the file named name,
+// which is served alone, that urlPath asks for, and whether urlPath is one
+// of the paths of the file. The file is shown at / and downloaded from
+// /_download, so that shared links are short, and nothing else in its
+// directory is served except the subtitles of the file.
+func singleFilePath(urlPath string, name string) (string, bool) {
+	filePath := "/" + name
+	switch urlPath {
+	case "/", filePath:
+		return filePath, true
+	case downloadPrefix, downloadPrefix + "/", downloadPrefix + filePath:
+		return downloadPrefix + filePath, true
+	case thumbPrefix + filePath, transcodePrefix + filePath:
+		return urlPath, true
+	}
+	if isRoute(urlPath, staticPrefix) || urlPath == versionPrefix || isBrowserRequest(urlPath) {
+		return urlPath, true
+	}
+	if isRoute(urlPath, subtitlePrefix) {
+		subtitle := strings.TrimPrefix(urlPath, subtitlePrefix)
+		base := strings.TrimSuffix(name, path.Ext(name))
+		if path.Dir(subtitle) == "/" && strings.HasPrefix(path.Base(subtitle), base+".") {
+			return urlPath, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:generate sh -c "mkdir -p static/video.js/6.4.0 && curl -sSfo static/video.js/6.4.0/video.min.js https://vjs.zencdn.net/6.4.0/video.min.js && curl -sSfo static/video.js/6.4.0/video-js.min.css https://vjs.zencdn.net/6.4.0/video-js.min.css"
+//go:generate sh -c "mkdir -p static/plyr/3.7.8 && curl -sSfo static/plyr/3.7.8/plyr.polyfilled.js https://cdn.plyr.io/3.7.8/plyr.polyfilled.js && curl -sSfo static/plyr/3.7.8/plyr.css https://cdn.plyr.io/3.7.8/plyr.css"
+//go:generate sh -c "mkdir -p static/videojs-contrib-hls/5.15.0 && curl -sSfo static/videojs-contrib-hls/5.15.0/videojs-contrib-hls.min.js https://unpkg.com/videojs-contrib-hls@5.15.0/dist/videojs-contrib-hls.min.js"
+
+const (
+	staticPrefix    = "/_static"
+	wellKnownPrefix = "/.well-known/"
+	videojsVersion  = "6.4.0"
+	videojsCDN      = "https://vjs.zencdn.net/" + videojsVersion
+	hlsVersion      = "5.15.0"
+	hlsCDN          = "https://unpkg.com/videojs-contrib-hls@" + hlsVersion + "/dist"
+	plyrVersion     = "3.7.8"
+	plyrCDN         = "https://cdn.plyr.io/" + plyrVersion
+)
+
+var (
+	//go:embed static
+	embeddedStatic embed.FS
+
+	staticFiles = func() fs.FS {
+		sub, err := fs.Sub(embeddedStatic, "static")
+		if err != nil {
+			panic(err)
+		}
+		return sub
+	}()
+
+	// iconPaths are requested by browsers on their own, whether or not the
+	// pages link them.
+	iconPaths = map[string]bool{
+		"/favicon.ico":                      true,
+		"/apple-touch-icon.png":             true,
+		"/apple-touch-icon-precomposed.png": true,
+	}
+)
+
+// playerAssets are the URLs the video player loads its stylesheet and script,
+// and for video.js the plugin playing HLS playlists, from.
+type playerAssets struct {
+	CSS string
+	JS  string
+	HLS string
+}
+
+// below returns the assets with the embedded ones served below base.
+func (p playerAssets) below(base string) playerAssets {
+	prefix := func(link string) string {
+		if strings.HasPrefix(link, staticPrefix+"/") {
+			return base + link
+		}
+		return link
+	}
+	return playerAssets{
+		CSS: prefix(p.CSS),
+		JS:  prefix(p.JS),
+		HLS: prefix(p.HLS),
+	}
+}
+
+// player is a video player the video page can be rendered with.
+type player struct {
+	template **template.Template
+	// assets returns where to load the player from, and whether that is
+	// the embedded copy, when told whether to use its CDN.
+	assets func(cdn bool) (playerAssets, bool)
+}
+
+var (
+	players = map[string]player{
+		"videojs": {
+			template: &videoTemplate,
+			assets:   videojsAssets,
+		},
+		"plyr": {
+			template: &plyrTemplate,
+			assets:   plyrAssets,
+		},
+		"native": {
+			template: &nativeTemplate,
+			assets: func(cdn bool) (playerAssets, bool) {
+				return playerAssets{}, true
+			},
+		},
+	}
+)
+
+// videojsAssets returns where to load video.js from. Unless cdn is set, the
+// embedded copy is used if it was fetched when building.
+func videojsAssets(cdn bool) (playerAssets, bool) {
+	local := path.Join("video.js", videojsVersion)
+	localHLS := path.Join("videojs-contrib-hls", hlsVersion, "videojs-contrib-hls.min.js")
+	if !cdn {
+		_, err := fs.Stat(staticFiles, path.Join(local, "video.min.js"))
+		_, hlsErr := fs.Stat(staticFiles, localHLS)
+		if err == nil && hlsErr == nil {
+			return playerAssets{
+				CSS: path.Join(staticPrefix, local, "video-js.min.css"),
+				JS:  path.Join(staticPrefix, local, "video.min.js"),
+				HLS: path.Join(staticPrefix, localHLS),
+			}, true
+		}
+	}
+	return playerAssets{
+		CSS: videojsCDN + "/video-js.min.css",
+		JS:  videojsCDN + "/video.min.js",
+		HLS: hlsCDN + "/videojs-contrib-hls.min.js",
+	}, false
+}
+
+// plyrAssets returns where to load Plyr from. Unless cdn is set, the embedded
+// copy is used if it was fetched when building.
+func plyrAssets(cdn bool) (playerAssets, bool) {
+	local := path.Join("plyr", plyrVersion)
+	if !cdn {
+		if _, err := fs.Stat(staticFiles, path.Join(local, "plyr.polyfilled.js")); err == nil {
+			return playerAssets{
+				CSS: path.Join(staticPrefix, local, "plyr.css"),
+				JS:  path.Join(staticPrefix, local, "plyr.polyfilled.js"),
+			}, true
+		}
+	}
+	return playerAssets{
+		CSS: plyrCDN + "/plyr.css",
+		JS:  plyrCDN + "/plyr.polyfilled.js",
+	}, false
+}
+
+func handleStatic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("X-Mediaweb-Handler", "static")
+	http.StripPrefix(staticPrefix, http.FileServer(http.FS(staticFiles))).ServeHTTP(w, r)
+}
+
+// isBrowserRequest returns whether urlPath is one of the paths browsers and
+// crawlers request on their own.
+func isBrowserRequest(urlPath string) bool {
+	return iconPaths[urlPath] || urlPath == "/robots.txt" || strings.HasPrefix(urlPath, wellKnownPrefix)
+}
+
+// handleBrowserRequest answers the requests browsers and crawlers make on
+// their own, so they don't end up as errors from the media directory.
+func handleBrowserRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("X-Mediaweb-Handler", "browser")
+	switch {
+	case iconPaths[r.URL.Path]:
+		icon, err := fs.ReadFile(staticFiles, "favicon.png")
+		if err != nil {
+			httpError(w, r, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		http.ServeContent(w, r, "favicon.png", time.Time{}, bytes.NewReader(icon))
+	case r.URL.Path == "/robots.txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("User-agent: *\nDisallow: /\n"))
+	default:
+		httpError(w, r, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,22 @@
+// Opens the next file in the directory when the one playing ends, and starts
+// playing files opened that way. The ended event doesn't bubble, so it is
+// caught on its way down to the player.
+(function() {
+  var next = document.currentScript.dataset.next;
+  document.addEventListener("ended", function(event) {
+    if (!next || !event.target.matches("video, audio")) {
+      return;
+    }
+    var url = new URL(next, location.href);
+    url.searchParams.set("autoplay", "1");
+    location.href = url.href;
+  }, true);
+  if (new URLSearchParams(location.search).get("autoplay")) {
+    var media = document.querySelector("video, audio");
+    if (media) {
+      media.play().catch(function() {
+        // Browsers may refuse to play before the page is interacted with.
+      });
+    }
+  }
+})();
@@ -0,0 +1,14 @@
+// Switches between the light and dark theme when the theme button is
+// clicked, and remembers the choice in a cookie.
+document.addEventListener("DOMContentLoaded", function() {
+  var button = document.querySelector("button.theme");
+  if (!button) {
+    return;
+  }
+  button.addEventListener("click", function() {
+    var root = document.documentElement;
+    var theme = root.getAttribute("data-theme") === "dark" ? "light" : "dark";
+    root.setAttribute("data-theme", theme);
+    document.cookie = button.dataset.cookie + "=" + theme + "; path=" + button.dataset.path + "; max-age=31536000; samesite=lax";
+  });
+});
@@ -0,0 +1,18 @@
+// Reloads the listing when files in its directory are added or removed. The
+// reload waits for the changes to settle, since copying a batch of files
+// causes many events.
+(function() {
+  var events = document.currentScript.dataset.events;
+  var timer = null;
+  var source = new EventSource(events);
+  source.addEventListener("change", function(event) {
+    var change = JSON.parse(event.data);
+    if (change.op === "write") {
+      return;
+    }
+    clearTimeout(timer);
+    timer = setTimeout(function() {
+      location.reload();
+    }, 1000);
+  });
+})();
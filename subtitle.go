@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	subtitlePrefix = "/_subtitle"
+	// maxSubtitleSize limits how large subtitles are converted, since they
+	// are read into memory. Real subtitles are far smaller.
+	maxSubtitleSize = 8 << 20
+)
+
+var (
+	subtitleExtensions = map[string]bool{
+		".srt": true,
+		".vtt": true,
+	}
+	srtTimestampReg = regexp.MustCompile(`^(\d+:\d\d:\d\d),(\d\d\d) --> (\d+:\d\d:\d\d),(\d\d\d)(.*)$`)
+)
+
+type subtitle struct {
+	Link    string
+	Label   string
+	Lang    string
+	Default bool
+}
+
+// findSubtitles returns the subtitles next to the video at realPath, served
+// at urlPath. Subtitles match if they are named like the video, optionally
+// with a language before the extension, like movie.en.srt for movie.mp4.
+// Subtitles without an extension in allowExt aren't served, and so not found.
+func findSubtitles(realPath string, urlPath string, allowExt extensions) ([]subtitle, error) {
+	dir, err := openFile(filepath.Dir(realPath))
+	if err != nil {
+		return nil, err
+	}
+	infos, err := dir.ReadDir(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(filepath.Base(realPath), filepath.Ext(realPath))
+	result := []subtitle{}
+	for _, info := range infos {
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if info.IsDir() || !subtitleExtensions[ext] || !allowExt.allows(info.Name()) {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		sub := subtitle{
+			Link:  (&url.URL{Path: path.Join(subtitlePrefix, path.Dir(urlPath), info.Name())}).EscapedPath(),
+			Label: "Subtitles",
+		}
+		if name != base {
+			if !strings.HasPrefix(name, base+".") {
+				continue
+			}
+			sub.Lang = strings.TrimPrefix(name, base+".")
+			sub.Label = sub.Lang
+		}
+		result = append(result, sub)
+	}
+	if len(result) > 0 {
+		result[0].Default = true
+	}
+	return result, nil
+}
+
+// srtToVTT converts the SubRip subtitles in src to WebVTT, which is the only
+// subtitle format browsers understand.
+func srtToVTT(dst io.Writer, src io.Reader) error {
+	if _, err := io.WriteString(dst, "WEBVTT\n\n"); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(src)
+	for first := true; scanner.Scan(); first = false {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		line = srtTimestampReg.ReplaceAllString(line, "$1.$2 --> $3.$4$5")
+		if _, err := fmt.Fprintln(dst, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func handleSubtitle(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "subtitle")
+	realPath, err := resolveURLPath(strings.TrimPrefix(r.URL.Path, subtitlePrefix), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(realPath))
+	if !subtitleExtensions[ext] {
+		httpError(w, r, fmt.Sprintf("%q is not a subtitle file", realPath), 400)
+		return
+	}
+	f, err := openFile(realPath)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	// Browsers only understand UTF-8 subtitles, so they are converted in
+	// memory. The file might grow while read, so its size is checked again.
+	if info.Size() > maxSubtitleSize {
+		httpError(w, r, fmt.Sprintf("%q is larger than %d bytes", realPath, maxSubtitleSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(f, maxSubtitleSize+1))
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	if len(content) > maxSubtitleSize {
+		httpError(w, r, fmt.Sprintf("%q is larger than %d bytes", realPath, maxSubtitleSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if content, err = toUTF8(content); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	if ext == ".vtt" {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(content))
+		return
+	}
+	// Converted subtitles are small, and sent whole even when ranges are asked
+	// for.
+	w.Header().Set("Accept-Ranges", "none")
+	if err := srtToVTT(w, bytes.NewReader(content)); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSubtitleSizeIsLimited(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"small.srt": "1\n00:00:01,000 --> 00:00:02,000\nHi\n"})
+	// Truncating makes a sparse file, which takes no room on disk.
+	huge, err := os.Create(filepath.Join(dir, "huge.srt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := huge.Truncate(maxSubtitleSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := huge.Close(); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	for target, want := range map[string]int{
+		subtitlePrefix + "/small.srt": http.StatusOK,
+		subtitlePrefix + "/huge.srt":  http.StatusRequestEntityTooLarge,
+	} {
+		if w := serve(handler, http.MethodGet, target, nil); w.Code != want {
+			t.Errorf("GET %s returned %d, wanted %d", target, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	//go:embed templates/*.html
+	defaultTemplates embed.FS
+
+	templateFuncs = template.FuncMap{
+		"join":          path.Join,
+		"href":          href,
+		"humanSize":     humanSize,
+		"humanTime":     humanTime,
+		"humanDuration": humanDuration,
+	}
+
+	// themes are the color schemes of the pages, defined in static/theme.css.
+	themes = map[string]bool{
+		"light": true,
+		"dark":  true,
+	}
+
+	// defaultTheme is set with -theme, and used unless the theme cookie
+	// chooses another.
+	defaultTheme = "light"
+
+	// siteTitle is set with -title, and names the site in page titles.
+	siteTitle = "Mediaweb"
+
+	// templates maps template file names to the variables holding them.
+	templates = map[string]**template.Template{
+		"dir.html":          &dirTemplate,
+		"video.html":        &videoTemplate,
+		"video-plyr.html":   &plyrTemplate,
+		"video-native.html": &nativeTemplate,
+		"image.html":        &imageTemplate,
+		"audio.html":        &audioTemplate,
+		"download.html":     &downloadTemplate,
+		"text.html":         &textTemplate,
+		"pdf.html":          &pdfTemplate,
+		"search.html":       &searchTemplate,
+		"index.html":        &indexTemplate,
+		"recent.html":       &recentTemplate,
+		"error.html":        &errorTemplate,
+	}
+)
+
+const (
+	themeCookie = "theme"
+)
+
+// theme returns the theme to render pages for r with.
+func theme(r *http.Request) string {
+	if cookie, err := r.Cookie(themeCookie); err == nil && themes[cookie.Value] {
+		return cookie.Value
+	}
+	return defaultTheme
+}
+
+// pageData adds what all page templates need, the base path and theme of
+// the request and the site title, to data.
+func pageData(r *http.Request, data map[string]interface{}) map[string]interface{} {
+	data["base"] = basePath(r)
+	data["theme"] = theme(r)
+	data["themeCookie"] = themeCookie
+	data["staticPrefix"] = staticPrefix
+	data["site"] = siteTitle
+	return data
+}
+
+// href joins the URL path elements and escapes each segment, so that names
+// containing characters like ?, # or spaces still link to the right place.
+func href(elems ...string) string {
+	segments := strings.Split(path.Join(elems...), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// humanSize formats size as a human readable number of bytes, like "1.4 GB".
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// humanDuration formats seconds like a media player does, like "1:02:03" or
+// "4:05".
+func humanDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	hours, minutes, secs := total/3600, total/60%60, total%60
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, secs)
+	}
+	return fmt.Sprintf("%d:%02d", minutes, secs)
+}
+
+// humanTime formats t relative to now, like "2 days ago", or as a date if it
+// is more than a month ago.
+func humanTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+	switch age := time.Since(t); {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return plural(int(age/time.Minute), "minute")
+	case age < 24*time.Hour:
+		return plural(int(age/time.Hour), "hour")
+	case age < 30*24*time.Hour:
+		return plural(int(age/(24*time.Hour)), "day")
+	default:
+		return t.Format("2006-01-02")
+	}
+}
+
+// loadTemplate parses the template named name from dir, or the embedded
+// default template if dir is empty or doesn't contain it.
+func loadTemplate(dir string, name string) (*template.Template, error) {
+	var content []byte
+	if dir != "" {
+		var err error
+		if content, err = os.ReadFile(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if content == nil {
+		var err error
+		if content, err = defaultTemplates.ReadFile("templates/" + name); err != nil {
+			return nil, err
+		}
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template %q: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+// loadTemplates replaces the default templates with those found in dir.
+func loadTemplates(dir string) error {
+	for name, tmpl := range templates {
+		loaded, err := loadTemplate(dir, name)
+		if err != nil {
+			return err
+		}
+		*tmpl = loaded
+	}
+	return nil
+}
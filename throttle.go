@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// throttle limits the total rate of bytes sent through all writers using it.
+// Writers reserve time slots for their bytes in turn, so concurrent
+// transfers share the bandwidth fairly.
+type throttle struct {
+	lock sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// newThrottle returns a throttle allowing rate bytes per second, or nil if
+// rate is less than 1, which means no limit.
+func newThrottle(rate int64) *throttle {
+	if rate < 1 {
+		return nil
+	}
+	return &throttle{rate: rate}
+}
+
+// wait blocks until n more bytes may be sent, or ctx is done.
+func (t *throttle) wait(ctx context.Context, n int) error {
+	t.lock.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	t.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writer returns w throttled by t, or w itself if t is nil.
+func (t *throttle) writer(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if t == nil {
+		return w
+	}
+	return &throttledWriter{
+		ResponseWriter: w,
+		throttle:       t,
+		ctx:            r.Context(),
+	}
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	throttle *throttle
+	ctx      context.Context
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	// Write in chunks of a tenth of a second, so that slow rates don't
+	// stall for seconds between large writes.
+	chunkSize := int(t.throttle.rate / 10)
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err := t.throttle.wait(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbPrefix = "/_thumb"
+	thumbWidth  = 320
+	// thumbMaxSize limits the width and height asked for with ?w= and ?h=,
+	// since scaling to huge sizes takes a lot of memory.
+	thumbMaxSize = 1920
+	// thumbMaxPixels limits how large images thumbnails are generated of,
+	// since decoding takes 4 bytes of memory per pixel, and small files can
+	// claim to hold huge images.
+	thumbMaxPixels = 64 << 20
+	// thumbMaxAge is how many seconds browsers may reuse a thumbnail without
+	// asking whether its file has changed.
+	thumbMaxAge = 86400
+	// thumbTimeout limits how long generating a thumbnail may take.
+	thumbTimeout = time.Minute
+	// thumbPlaceholder is shown by the listing when a thumbnail can't be generated.
+	thumbPlaceholder = `data:image/svg+xml,%3Csvg xmlns=%27http://www.w3.org/2000/svg%27 width=%27160%27 height=%2790%27%3E%3Crect width=%27160%27 height=%2790%27 fill=%27%23ccc%27/%3E%3C/svg%3E`
+)
+
+var (
+	// canExtractFrames returns whether ffmpeg and ffprobe are installed, so
+	// that video thumbnails can be generated.
+	canExtractFrames = sync.OnceValue(func() bool {
+		for _, command := range []string{"ffmpeg", "ffprobe"} {
+			if _, err := exec.LookPath(command); err != nil {
+				infof("%s not found, video thumbnails and posters are disabled: %v", command, err)
+				return false
+			}
+		}
+		return true
+	})
+	// thumbJobs limits how many thumbnails are generated at once, since
+	// decoding images and running ffmpeg take a lot of memory and CPU. It is
+	// sized with -max_thumb_jobs.
+	thumbJobs = make(chan struct{}, runtime.NumCPU())
+)
+
+// thumbSize is the box a thumbnail is scaled down to fit in, keeping its
+// aspect ratio. A zero width or height doesn't limit that dimension.
+type thumbSize struct {
+	width  int
+	height int
+}
+
+// parseThumbSize returns the size asked for by the w and h query parameters
+// of r, or thumbWidth wide if neither is given.
+func parseThumbSize(r *http.Request) (thumbSize, error) {
+	result := thumbSize{}
+	for _, dim := range []struct {
+		param string
+		value *int
+	}{
+		{"w", &result.width},
+		{"h", &result.height},
+	} {
+		param := r.URL.Query().Get(dim.param)
+		if param == "" {
+			continue
+		}
+		value, err := strconv.Atoi(param)
+		if err != nil || value < 1 || value > thumbMaxSize {
+			return thumbSize{}, fmt.Errorf("invalid %s %q, must be between 1 and %d", dim.param, param, thumbMaxSize)
+		}
+		*dim.value = value
+	}
+	if result.width == 0 && result.height == 0 {
+		result.width = thumbWidth
+	}
+	return result, nil
+}
+
+// fit returns width and height scaled down to fit in s, keeping the aspect
+// ratio. Smaller sizes are returned as they are.
+func (s thumbSize) fit(width int, height int) (int, int) {
+	if s.width > 0 && width > s.width {
+		width, height = s.width, height*s.width/width
+	}
+	if s.height > 0 && height > s.height {
+		width, height = width*s.height/height, s.height
+	}
+	return max(width, 1), max(height, 1)
+}
+
+// ffmpegScale returns the ffmpeg scale filter scaling frames to fit in s.
+func (s thumbSize) ffmpegScale() string {
+	switch {
+	case s.height == 0:
+		return fmt.Sprintf("scale=%d:-2", s.width)
+	case s.width == 0:
+		return fmt.Sprintf("scale=-2:%d", s.height)
+	default:
+		return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", s.width, s.height)
+	}
+}
+
+// thumbPath returns where the thumbnail of the given size for the file at
+// realPath, described by info, is cached. The name depends on size and
+// modification time, so that changed files get new thumbnails.
+func thumbPath(thumbDir string, realPath string, info os.FileInfo, size thumbSize) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d", realPath, info.Size(), info.ModTime().UnixNano())))
+	if size == (thumbSize{width: thumbWidth}) {
+		// Thumbnails of the default size keep their names from before
+		// sizes could be asked for.
+		return filepath.Join(thumbDir, fmt.Sprintf("%x.jpg", sum))
+	}
+	return filepath.Join(thumbDir, fmt.Sprintf("%x-%dx%d.jpg", sum, size.width, size.height))
+}
+
+// videoDuration returns the duration in seconds of the video at realPath.
+// ffprobe is killed if ctx is done first.
+func videoDuration(ctx context.Context, realPath string) (float64, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", realPath).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+}
+
+// generateThumb stores a JPEG thumbnail of the video or image at realPath,
+// fitting in size, at thumbFile. It gives up when ctx is done, also while
+// waiting for a slot in thumbJobs.
+func generateThumb(ctx context.Context, realPath string, mimeType string, size thumbSize, thumbFile string) error {
+	select {
+	case thumbJobs <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-thumbJobs }()
+	if err := os.MkdirAll(filepath.Dir(thumbFile), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file of our own first, so concurrent requests
+	// neither see half written thumbnails nor write into each other's.
+	tmp, err := os.CreateTemp(filepath.Dir(thumbFile), "*.tmp.jpg")
+	if err != nil {
+		return err
+	}
+	tmpFile := tmp.Name()
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if mimeType == "image" {
+		err = scaleImage(realPath, size, tmpFile)
+	} else {
+		err = extractFrame(ctx, realPath, size, tmpFile)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Rename(tmpFile, thumbFile); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return nil
+}
+
+// scaleImage stores the image at realPath, scaled down to fit in size, as a
+// JPEG at thumbFile.
+func scaleImage(realPath string, size thumbSize, thumbFile string) error {
+	in, err := openFile(realPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	config, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return fmt.Errorf("unable to decode %q: %v", realPath, err)
+	}
+	if int64(config.Width)*int64(config.Height) > thumbMaxPixels {
+		return fmt.Errorf("%q is %dx%d, which is more than the %d pixels thumbnails are generated of", realPath, config.Width, config.Height, thumbMaxPixels)
+	}
+	if _, err := in.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(in)
+	if err != nil {
+		return fmt.Errorf("unable to decode %q: %v", realPath, err)
+	}
+	bounds := src.Bounds()
+	width, height := size.fit(bounds.Dx(), bounds.Dy())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	out, err := os.Create(thumbFile)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, dst, nil); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// extractFrame extracts a frame from 10% into the video at realPath and
+// stores it, scaled to fit in size, as a JPEG at thumbFile.
+func extractFrame(ctx context.Context, realPath string, size thumbSize, thumbFile string) error {
+	duration, err := videoDuration(ctx, realPath)
+	if err != nil {
+		return fmt.Errorf("unable to find duration of %q: %v", realPath, err)
+	}
+	if out, err := exec.CommandContext(ctx, "ffmpeg", "-v", "error", "-y", "-ss", fmt.Sprintf("%.3f", duration/10), "-i", realPath, "-frames:v", "1", "-vf", size.ffmpegScale(), thumbFile).CombinedOutput(); err != nil {
+		return fmt.Errorf("unable to extract frame from %q: %v: %s", realPath, err, out)
+	}
+	return nil
+}
+
+func handleThumb(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "thumb")
+	realPath, err := resolveURLPath(strings.TrimPrefix(r.URL.Path, thumbPrefix), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	size, err := parseThumbSize(r)
+	if err != nil {
+		httpError(w, r, err.Error(), 400)
+		return
+	}
+	thumbFile := thumbPath(opts.thumbDir, realPath, info, size)
+	if _, err := os.Stat(thumbFile); os.IsNotExist(err) {
+		fileType, err := opts.types.match(realPath, info)
+		if err != nil {
+			httpError(w, r, err.Error(), 500)
+			return
+		}
+		if fileType.MIME.Type != "video" && fileType.MIME.Type != "image" {
+			httpError(w, r, fmt.Sprintf("%q is neither a video nor an image", realPath), 400)
+			return
+		}
+		// ffmpeg can hang on broken files, and is pointless once the client
+		// is gone.
+		ctx, cancel := context.WithTimeout(r.Context(), thumbTimeout)
+		defer cancel()
+		if err := generateThumb(ctx, realPath, fileType.MIME.Type, size, thumbFile); err != nil {
+			httpError(w, r, err.Error(), 500)
+			return
+		}
+	}
+	f, err := openFile(thumbFile)
+	if err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	// Thumbnails only change when their files do, so they are cached like
+	// the files. Shared caches mustn't keep thumbnails of files behind a
+	// login.
+	w.Header().Set("ETag", fileETag(info))
+	if opts.creds != nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", thumbMaxAge))
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", thumbMaxAge))
+	}
+	http.ServeContent(w, r, filepath.Base(thumbFile), info.ModTime(), f)
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThumbKillsHungFFmpeg(t *testing.T) {
+	bin := t.TempDir()
+	for _, command := range []string{"ffprobe", "ffmpeg"} {
+		if err := os.WriteFile(filepath.Join(bin, command), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"movie.mp4": "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"})
+	handler := http.HandlerFunc(handlerFunc(testOptions(t, dir)))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodGet, "/_thumb/movie.mp4", nil).WithContext(ctx)
+	code := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		code <- w.Code
+	}()
+	select {
+	case got := <-code:
+		if got != 500 {
+			t.Errorf("got %d", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the thumbnail waited for ffprobe after the client went away")
+	}
+	if len(thumbJobs) != 0 {
+		t.Errorf("%d thumbnail slots are still taken", len(thumbJobs))
+	}
+}
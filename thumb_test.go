@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentThumbs(t *testing.T) {
+	dir := t.TempDir()
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 400, 300))); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"picture.png": buf.String()})
+	opts := testOptions(t, dir)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(handler, http.MethodGet, "/_thumb/picture.png?h=128", nil)
+			if w.Code != 200 {
+				t.Errorf("got %d: %s", w.Code, w.Body)
+				return
+			}
+			if _, err := jpeg.Decode(w.Body); err != nil {
+				t.Errorf("got a broken thumbnail: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := filepath.Walk(opts.thumbDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasSuffix(path, ".tmp.jpg") {
+			t.Errorf("%q was left behind", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pngHeader returns the start of a PNG image width by height pixels large,
+// which is enough for its size to be read.
+func pngHeader(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 2, 0, 0, 0)
+	result := []byte("\x89PNG\r\n\x1a\n")
+	result = binary.BigEndian.AppendUint32(result, uint32(len(ihdr)-4))
+	result = append(result, ihdr...)
+	return binary.BigEndian.AppendUint32(result, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestThumbRefusesHugeImages(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"bomb.png": string(pngHeader(100000, 100000))})
+	opts := testOptions(t, dir)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	w := serve(handler, http.MethodGet, "/_thumb/bomb.png", nil)
+	if w.Code != 500 || !strings.Contains(w.Body.String(), "pixels") {
+		t.Errorf("got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestThumbJobsAreLimited(t *testing.T) {
+	dir := t.TempDir()
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, dir, map[string]string{"picture.png": buf.String()})
+	opts := testOptions(t, dir)
+	handler := http.HandlerFunc(handlerFunc(opts))
+	oldJobs := thumbJobs
+	thumbJobs = make(chan struct{}, 1)
+	t.Cleanup(func() {
+		thumbJobs = oldJobs
+	})
+	// With the only slot taken, thumbnails wait for it.
+	thumbJobs <- struct{}{}
+	code := make(chan int, 1)
+	go func() {
+		code <- serve(handler, http.MethodGet, "/_thumb/picture.png", nil).Code
+	}()
+	select {
+	case got := <-code:
+		t.Fatalf("got %d without waiting for a slot", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	<-thumbJobs
+	if got := <-code; got != 200 {
+		t.Errorf("got %d", got)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	transcodePrefix = "/_transcode"
+)
+
+var (
+	// browserContainers, browserVideoCodecs and browserAudioCodecs are what
+	// current browsers play without help.
+	browserContainers = map[string]bool{
+		"video/mp4":   true,
+		"video/webm":  true,
+		"video/ogg":   true,
+		"video/x-m4v": true,
+	}
+	browserVideoCodecs = map[string]bool{
+		"h264":   true,
+		"vp8":    true,
+		"vp9":    true,
+		"av1":    true,
+		"theora": true,
+	}
+	browserAudioCodecs = map[string]bool{
+		"aac":    true,
+		"mp3":    true,
+		"opus":   true,
+		"vorbis": true,
+		"flac":   true,
+	}
+)
+
+// canTranscode returns whether ffmpeg and ffprobe are installed, so that
+// videos can be transcoded.
+func canTranscode() bool {
+	if !canExtractFrames() {
+		errorf("Transcoding is disabled, since it needs ffmpeg and ffprobe")
+		return false
+	}
+	return true
+}
+
+// needsTranscoding returns whether browsers are unlikely to play the video
+// of type mimeType described by info.
+func needsTranscoding(mimeType string, info mediaInfo) bool {
+	if !browserContainers[mimeType] {
+		return true
+	}
+	if info.videoCodec != "" && !browserVideoCodecs[info.videoCodec] {
+		return true
+	}
+	return info.audioCodec != "" && !browserAudioCodecs[info.audioCodec]
+}
+
+// handleTranscode streams the video below transcodePrefix as fragmented MP4
+// with H.264 and AAC, converted by ffmpeg while it is sent. The result can't
+// be seeked in, since it doesn't exist before it is sent.
+func handleTranscode(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "transcode")
+	if !opts.transcode {
+		httpError(w, r, "transcoding is disabled, enable it with -transcode", http.StatusNotFound)
+		return
+	}
+	realPath, err := resolveURLPath(strings.TrimPrefix(r.URL.Path, transcodePrefix), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	fileType, err := detectType(realPath)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	if fileType.MIME.Type != "video" {
+		httpError(w, r, fmt.Sprintf("%q is not a video", realPath), 400)
+		return
+	}
+	// Like downloads, transcoding takes longer than the write timeout.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	// Ranges of it can't be served, so Range requests get the whole video.
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == http.MethodHead {
+		return
+	}
+	// ffmpeg is killed when the client goes away.
+	cmd := exec.CommandContext(r.Context(), "ffmpeg", "-v", "error", "-i", realPath,
+		"-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "pipe:1")
+	sw := &statusWriter{ResponseWriter: w}
+	cmd.Stdout = opts.throttle.writer(sw, r)
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil && r.Context().Err() == nil {
+		if sw.bytes == 0 {
+			httpError(w, r, fmt.Sprintf("unable to transcode %q: %v: %s", realPath, err, stderr), 500)
+			return
+		}
+		// The headers are already sent, so all we can do is log and abort.
+		logger(r).errorf("Unable to transcode %q: %v: %s", realPath, err, stderr)
+		panic(http.ErrAbortHandler)
+	}
+}
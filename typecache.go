@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/h2non/filetype.v1/types"
+)
+
+type typeCacheEntry struct {
+	path     string
+	size     int64
+	modTime  time.Time
+	fileType types.Type
+}
+
+// typeCache remembers detected file types, so that listings don't have to
+// re-read the header of every file on every request. Entries are invalidated
+// when the size or modification time of the file changes, and the least
+// recently used entries are evicted when the cache is full.
+type typeCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newTypeCache(size int) *typeCache {
+	return &typeCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// match returns the type of the file at path, described by info, as detected
+// by detectType.
+func (c *typeCache) match(path string, info os.FileInfo) (types.Type, error) {
+	if c == nil || c.size < 1 {
+		return detectType(path)
+	}
+	c.lock.Lock()
+	if elem, found := c.entries[path]; found {
+		entry := elem.Value.(*typeCacheEntry)
+		if entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			c.order.MoveToFront(elem)
+			c.lock.Unlock()
+			return entry.fileType, nil
+		}
+		c.order.Remove(elem)
+		delete(c.entries, path)
+	}
+	c.lock.Unlock()
+
+	fileType, err := detectType(path)
+	if err != nil {
+		return fileType, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, found := c.entries[path]; found {
+		c.order.Remove(elem)
+	}
+	c.entries[path] = c.order.PushFront(&typeCacheEntry{
+		path:     path,
+		size:     info.Size(),
+		modTime:  info.ModTime(),
+		fileType: fileType,
+	})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*typeCacheEntry).path)
+	}
+	return fileType, nil
+}
+
+// matchAll returns the types of the files among infos, which describe the
+// contents of dir, and the errors detecting them, in the same order as infos.
+// Directories get empty types. At most workers files are read at once, so
+// that huge directories don't exhaust the file descriptors.
+func (c *typeCache) matchAll(dir string, infos []os.FileInfo, workers int) ([]types.Type, []error) {
+	fileTypes := make([]types.Type, len(infos))
+	errs := make([]error, len(infos))
+	if workers < 1 {
+		workers = 1
+	}
+	indices := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				fileTypes[index], errs[index] = c.match(filepath.Join(dir, infos[index].Name()), infos[index])
+			}
+		}()
+	}
+	for index, info := range infos {
+		if !info.IsDir() {
+			indices <- index
+		}
+	}
+	close(indices)
+	wg.Wait()
+	return fileTypes, errs
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+const (
+	versionPrefix = "/_version"
+)
+
+var (
+	// version and commit describe this build, and are set with
+	// -ldflags "-X main.version=... -X main.commit=...". Without them, the
+	// commit recorded by the Go toolchain is used when there is one.
+	version = "dev"
+	commit  = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+}
+
+// currentBuild returns the version, commit and Go version of this build.
+func currentBuild() buildInfo {
+	result := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}
+	if result.Commit == "" {
+		result.Commit = "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					result.Commit = setting.Value
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (b buildInfo) String() string {
+	return fmt.Sprintf("mediaweb %s (commit %s, %s)", b.Version, b.Commit, b.GoVersion)
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("X-Mediaweb-Handler", "version")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentBuild()); err != nil {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	zipPrefix = "/_zip"
+)
+
+var (
+	errZipTooLarge = errors.New("too large to zip")
+)
+
+type zipFile struct {
+	realPath string
+	name     string
+	info     fs.FileInfo
+}
+
+// zipFiles returns the regular files below dir, named relative to dir, that
+// are listed for and may be seen by the user of opts. It fails if there are
+// more than maxFiles files or they are larger than maxBytes in total, unless
+// the limits are 0.
+func zipFiles(dir string, opts options, maxFiles int, maxBytes int64) ([]zipFile, error) {
+	result := []zipFile{}
+	totalBytes := int64(0)
+	if err := filepath.WalkDir(dir, func(realPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if realPath != dir && (!isListed(d.Name(), opts.hidden) || !isAllowed(d.Name(), d.IsDir(), opts.allowExt) || (d.IsDir() && !mayEnter(realPath, opts))) {
+			return skipEntry(d)
+		}
+		// Symlinks and other special files could point outside of dir.
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, realPath)
+		if err != nil {
+			return err
+		}
+		result = append(result, zipFile{
+			realPath: realPath,
+			name:     filepath.ToSlash(name),
+			info:     info,
+		})
+		totalBytes += info.Size()
+		if maxFiles > 0 && len(result) > maxFiles {
+			return fmt.Errorf("%w: %q contains more than %d files", errZipTooLarge, dir, maxFiles)
+		}
+		if maxBytes > 0 && totalBytes > maxBytes {
+			return fmt.Errorf("%w: %q contains more than %d bytes", errZipTooLarge, dir, maxBytes)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// selectedZipFiles returns the files named by the relative paths names in
+// the directory dir, which is at urlPath. Directories among them are zipped
+// with everything below them. Like zipFiles, it fails if there are more than
+// maxFiles files or they are larger than maxBytes in total, unless the limits
+// are 0.
+func selectedZipFiles(dir string, urlPath string, names []string, opts options) ([]zipFile, error) {
+	result := []zipFile{}
+	seen := map[string]bool{}
+	totalBytes := int64(0)
+	for _, name := range names {
+		// The names come from the client, so they get the same checks as
+		// any requested path, and have to be inside dir.
+		realPath, err := resolveURLPath(path.Join(urlPath, name), opts)
+		if err != nil {
+			return nil, err
+		}
+		if realPath == dir || !isInside(dir, realPath) {
+			return nil, fmt.Errorf("%w: %q is not inside %q", errOutside, name, urlPath)
+		}
+		rel, err := filepath.Rel(dir, realPath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(realPath)
+		if err != nil {
+			return nil, err
+		}
+		files := []zipFile{}
+		if info.IsDir() {
+			if files, err = zipFiles(realPath, opts, 0, 0); err != nil {
+				return nil, err
+			}
+			for i := range files {
+				files[i].name = path.Join(filepath.ToSlash(rel), files[i].name)
+			}
+		} else if info.Mode().IsRegular() {
+			files = append(files, zipFile{
+				realPath: realPath,
+				name:     filepath.ToSlash(rel),
+				info:     info,
+			})
+		}
+		for _, file := range files {
+			if seen[file.name] {
+				continue
+			}
+			seen[file.name] = true
+			result = append(result, file)
+			totalBytes += file.info.Size()
+		}
+		if opts.zipMaxFiles > 0 && len(result) > opts.zipMaxFiles {
+			return nil, fmt.Errorf("%w: the selection contains more than %d files", errZipTooLarge, opts.zipMaxFiles)
+		}
+		if opts.zipMaxBytes > 0 && totalBytes > opts.zipMaxBytes {
+			return nil, fmt.Errorf("%w: the selection contains more than %d bytes", errZipTooLarge, opts.zipMaxBytes)
+		}
+	}
+	return result, nil
+}
+
+// writeZip streams files as a zip archive to w. The files are stored without
+// compression, since media is already compressed.
+func writeZip(w io.Writer, files []zipFile) error {
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		header, err := zip.FileInfoHeader(file.info)
+		if err != nil {
+			return err
+		}
+		header.Name = file.name
+		header.Method = zip.Store
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		// Entries stay open while they are sent to slow clients.
+		f, err := openHeldFile(file.realPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func handleZip(w http.ResponseWriter, r *http.Request, opts options) {
+	w.Header().Add("X-Mediaweb-Handler", "zip")
+	realPath, err := resolveURLPath(strings.TrimPrefix(r.URL.Path, zipPrefix), opts)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	info, err := os.Stat(realPath)
+	if err != nil {
+		httpError(w, r, err.Error(), errorStatus(err))
+		return
+	}
+	if !info.IsDir() {
+		httpError(w, r, fmt.Sprintf("%q is not a directory", realPath), 400)
+		return
+	}
+	var files []zipFile
+	if r.Method == http.MethodPost {
+		// Forms post the selected files as relative paths in file fields.
+		if err := r.ParseForm(); err != nil {
+			httpError(w, r, err.Error(), 400)
+			return
+		}
+		names := r.PostForm["file"]
+		if len(names) == 0 {
+			httpError(w, r, "no files selected", 400)
+			return
+		}
+		files, err = selectedZipFiles(realPath, strings.TrimPrefix(r.URL.Path, zipPrefix), names, opts)
+		if errors.Is(err, errZipTooLarge) {
+			httpError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			httpError(w, r, err.Error(), errorStatus(err))
+			return
+		}
+	} else {
+		files, err = zipFiles(realPath, opts, opts.zipMaxFiles, opts.zipMaxBytes)
+		if errors.Is(err, errZipTooLarge) {
+			httpError(w, r, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			httpError(w, r, err.Error(), 500)
+			return
+		}
+	}
+	// Like downloads, zips of whole folders take too long for the write timeout.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		httpError(w, r, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	// Zips are made while they are sent, so there is nothing to seek in and
+	// Range headers get the whole zip.
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filepath.Base(realPath) + ".zip",
+	}))
+	// The size isn't known before zipping, so HEAD only gets the type.
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := writeZip(opts.throttle.writer(w, r), files); err != nil {
+		// The headers are already sent, so all we can do is log and abort.
+		logger(r).errorf("Unable to zip %q: %v", realPath, err)
+		panic(http.ErrAbortHandler)
+	}
+}